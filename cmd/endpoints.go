@@ -1,9 +1,8 @@
 package cmd
 
 import (
-	"fmt"
+	"expvar"
 	"github.com/gorilla/mux"
-	"github.com/spf13/viper"
 	"net/http"
 )
 
@@ -53,11 +52,23 @@ var Routes = []Route{
 		Pattern:     "/api/v1/TokenPermission",
 		HandlerFunc: TokenPermission,
 	},
+	{
+		Name:        "Metrics",
+		Method:      "GET",
+		Pattern:     "/api/v1/Metrics",
+		HandlerFunc: expvar.Handler().ServeHTTP,
+	},
+	{
+		Name:        "Status",
+		Method:      "GET",
+		Pattern:     "/api/v1/Status",
+		HandlerFunc: Status,
+	},
 }
 var RoutesCopy []Route
 
 func AddRoutes(router *mux.Router) *mux.Router {
-	for _, route := range Routes {
+	for _, route := range append(Routes, scimRoutes()...) {
 		router.Methods(route.Method).Path(route.Pattern).Handler(route.HandlerFunc)
 		RoutesCopy = append(RoutesCopy, route)
 	}
@@ -67,8 +78,7 @@ func AddRoutes(router *mux.Router) *mux.Router {
 func GetEntryPoints() map[string]string {
 	entryPoints := make(map[string]string)
 	for _, route := range RoutesCopy {
-		entryPoints[route.Name] = fmt.Sprintf("http://%s:%s%s",
-			viper.GetString("connector.hostname"), viper.GetString("connector.port"), route.Pattern)
+		entryPoints[route.Name] = connectorUrl(route.Pattern)
 	}
 	return entryPoints
 }
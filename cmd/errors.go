@@ -0,0 +1,98 @@
+package cmd
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// an error reported to the clients of the connector as a SCIM error (RFC 7644 section 3.12). status is the http
+// status of the response and scimType the SCIM detail error keyword, which is empty for errors without keyword
+type scimError struct {
+	status   int
+	scimType string
+	detail   string
+	// sent as Retry-After header when set
+	retryAfter time.Duration
+}
+
+func (e *scimError) Error() string {
+	return e.detail
+}
+
+func newScimError(status int, scimType string, format string, args ...interface{}) *scimError {
+	return &scimError{status: status, scimType: scimType, detail: fmt.Sprintf(format, args...)}
+}
+
+// the requested resource does not exist
+func notFoundError(format string, args ...interface{}) *scimError {
+	return newScimError(http.StatusNotFound, "", format, args...)
+}
+
+// the resource to create already exists
+func uniquenessError(format string, args ...interface{}) *scimError {
+	return newScimError(http.StatusConflict, "uniqueness", format, args...)
+}
+
+// an attribute value is not valid
+func invalidValueError(format string, args ...interface{}) *scimError {
+	return newScimError(http.StatusBadRequest, "invalidValue", format, args...)
+}
+
+// the request body is not valid
+func invalidSyntaxError(format string, args ...interface{}) *scimError {
+	return newScimError(http.StatusBadRequest, "invalidSyntax", format, args...)
+}
+
+// the target of an operation does not exist
+func noTargetError(format string, args ...interface{}) *scimError {
+	return newScimError(http.StatusBadRequest, "noTarget", format, args...)
+}
+
+// an attribute cannot be modified
+func mutabilityError(format string, args ...interface{}) *scimError {
+	return newScimError(http.StatusBadRequest, "mutability", format, args...)
+}
+
+// a path of a PATCH operation is not valid
+func invalidPathError(format string, args ...interface{}) *scimError {
+	return newScimError(http.StatusBadRequest, "invalidPath", format, args...)
+}
+
+// map an unexpected http status received from SMC to the error reported to the clients
+func smcStatusError(status int, format string, args ...interface{}) *scimError {
+	detail := fmt.Sprintf(format, args...) + fmt.Sprintf(": unexpected http status %d received from SMC", status)
+	switch status {
+	case http.StatusNotFound:
+		return newScimError(http.StatusNotFound, "", "%s", detail)
+	case http.StatusConflict, http.StatusUnprocessableEntity:
+		return newScimError(http.StatusConflict, "uniqueness", "%s", detail)
+	case http.StatusBadRequest:
+		return newScimError(http.StatusBadRequest, "invalidValue", "%s", detail)
+	case http.StatusPreconditionFailed:
+		return newScimError(http.StatusPreconditionFailed, "", "%s", detail)
+	}
+	return newScimError(http.StatusBadGateway, "", "%s", detail)
+}
+
+// SMC answered a request with an unexpected response
+func smcBadResponseError(err error) *scimError {
+	return newScimError(http.StatusBadGateway, "", "unexpected response received from SMC: %s", err.Error())
+}
+
+// SMC cannot be reached or refused the login of the connector
+func smcUnavailableError(err error) *scimError {
+	return newScimError(http.StatusServiceUnavailable, "", "failed in connecting to SMC: %s", err.Error())
+}
+
+// SMC is down and the requests to SMC are rejected by the circuit breaker until retryAfter has passed
+func smcCircuitOpenScimError(retryAfter time.Duration) *scimError {
+	err := newScimError(http.StatusServiceUnavailable, "", "%s", (&smcCircuitOpenError{retryAfter}).Error())
+	err.retryAfter = retryAfter
+	return err
+}
+
+// SMC did not answer in time, or the request of the client has been cancelled
+func smcTimeoutError(err error) *scimError {
+	return newScimError(http.StatusGatewayTimeout, "", "SMC did not answer in time: %s", err.Error())
+}
@@ -0,0 +1,381 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.cicd.cloud.fpdev.io/BD/fp-smc-golang/src/smc"
+	"github.com/gorilla/mux"
+	"github.com/spf13/viper"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+const fakeSmcApiVersion = "6.7"
+
+// a fake SMC serving the parts of the SMC API used by the connector. the admins and the users of the LDAP domain are
+// kept in memory, the requests are counted and the concurrent requests tracked
+type fakeSmc struct {
+	server *httptest.Server
+
+	mu      sync.Mutex
+	session string
+	logins  int
+	admins  map[int]map[string]interface{}
+	nextKey int
+	// the unique IDs of the users of the LDAP search base by their name
+	ldapUsers map[string]string
+	// the number of requests by method and path, such as "PUT /6.7/elements/admin_user/1"
+	requests    map[string]int
+	inFlight    int
+	maxInFlight int
+	// when set, the requests it returns a status for are answered with that status
+	fail func(r *http.Request) int
+}
+
+// start a fake SMC and configure the connector to use it. the returned SMC must be closed
+func newFakeSmc(t *testing.T) *fakeSmc {
+	f := &fakeSmc{
+		admins:    make(map[int]map[string]interface{}),
+		nextKey:   1,
+		ldapUsers: make(map[string]string),
+		requests:  make(map[string]int),
+	}
+	f.server = httptest.NewServer(http.HandlerFunc(f.serve))
+	host, port, err := net.SplitHostPort(f.server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	viper.Reset()
+	setConfigDefaults()
+	viper.Set("SMC.IP_ADDRESS", host)
+	viper.Set("SMC.PORT", port)
+	viper.Set("SMC.API_VERSION", fakeSmcApiVersion)
+	viper.Set("LDAP_DOMAIN", "contoso")
+	viper.Set("SMC.REQUEST_TIMEOUT_IN_SECONDS", 10)
+	viper.Set("SMC.RETRY_BASE_DELAY_IN_MILLISECONDS", 1)
+	viper.Set("SMC.RETRY_MAX_DELAY_IN_SECONDS", 0)
+	smcElements = newSmcElementCache()
+	smcUserIndex = newSmcUserCache()
+	smcSession = NewSmcSession(&smc.Smc{Hostname: host, Port: port, APIVersion: configuredSmcApiVersion()})
+	if err := InstallSmcClient(); err != nil {
+		f.Close()
+		t.Fatal(err)
+	}
+	return f
+}
+
+func (f *fakeSmc) Close() {
+	f.server.Close()
+}
+
+// the URL of a path of the versioned SMC API
+func (f *fakeSmc) url(path string) string {
+	return f.server.URL + "/" + fakeSmcApiVersion + path
+}
+
+// add an admin authenticated by a new user of the LDAP domain and return the href of the admin
+func (f *fakeSmc) addAdmin(name string, enabled bool) string {
+	id := f.addLdapUser(name)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	key := f.nextKey
+	f.nextKey++
+	f.admins[key] = map[string]interface{}{
+		"name":        name,
+		"enabled":     enabled,
+		"auth_method": f.url("/elements/authentication_service/1"),
+		"ldap_user":   f.url("/ldap/users/" + id),
+		"key":         key,
+		"permissions": map[string]interface{}{"permission": []interface{}{}},
+	}
+	return f.adminHref(key)
+}
+
+// add a user to the LDAP search base and return its unique ID
+func (f *fakeSmc) addLdapUser(name string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	id := fmt.Sprintf("id-%s", name)
+	f.ldapUsers[name] = id
+	return id
+}
+
+// a copy of the admin with the given name, nil if there is none
+func (f *fakeSmc) admin(name string) map[string]interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if key, ok := f.adminKey(name); ok {
+		return copyFakeAdmin(f.admins[key])
+	}
+	return nil
+}
+
+// change an admin as if done by another client of SMC
+func (f *fakeSmc) updateAdmin(name string, update func(admin map[string]interface{})) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if key, ok := f.adminKey(name); ok {
+		update(f.admins[key])
+	}
+}
+
+func (f *fakeSmc) deleteAdmin(name string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if key, ok := f.adminKey(name); ok {
+		delete(f.admins, key)
+	}
+}
+
+// drop the session, as SMC does when the session times out
+func (f *fakeSmc) expireSession() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.session = ""
+}
+
+// the number of requests received with the given method on the given path of the versioned SMC API
+func (f *fakeSmc) count(method string, path string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.requests[method+" /"+fakeSmcApiVersion+path]
+}
+
+func (f *fakeSmc) loginCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.logins
+}
+
+// the highest number of requests SMC received at the same time
+func (f *fakeSmc) concurrentRequests() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.maxInFlight
+}
+
+func (f *fakeSmc) setFailure(fail func(r *http.Request) int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.fail = fail
+}
+
+func (f *fakeSmc) adminKey(name string) (int, bool) {
+	for key, admin := range f.admins {
+		if admin["name"] == name {
+			return key, true
+		}
+	}
+	return 0, false
+}
+
+func (f *fakeSmc) adminHref(key int) string {
+	return f.url("/elements/admin_user/" + strconv.Itoa(key))
+}
+
+func (f *fakeSmc) serve(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests[r.Method+" "+r.URL.Path]++
+	f.inFlight++
+	if f.inFlight > f.maxInFlight {
+		f.maxInFlight = f.inFlight
+	}
+	defer func() { f.inFlight-- }()
+	// the lock is released while the request is read so that concurrent requests are seen
+	f.mu.Unlock()
+	var body map[string]interface{}
+	if r.Body != nil {
+		json.NewDecoder(r.Body).Decode(&body)
+	}
+	f.mu.Lock()
+	if f.fail != nil {
+		if status := f.fail(r); status != 0 {
+			w.WriteHeader(status)
+			return
+		}
+	}
+	prefix := "/" + fakeSmcApiVersion
+	path := strings.TrimPrefix(r.URL.Path, prefix)
+	switch {
+	case r.URL.Path == "/api":
+		f.writeJSON(w, http.StatusOK, map[string]interface{}{"version": []map[string]string{
+			{"rel": fakeSmcApiVersion, "href": f.server.URL + prefix + "/api"},
+		}})
+		return
+	case path == "/login" && r.Method == http.MethodPost:
+		f.logins++
+		f.session = fmt.Sprintf("JSESSIONID=session%d", f.logins)
+		w.Header().Set("Set-Cookie", f.session+"; Path=/; HttpOnly")
+		w.WriteHeader(http.StatusOK)
+		return
+	case path == "/api":
+		var entryPoints []map[string]string
+		for _, rel := range []string{"admin_user", "role", "admin_domain", "access_control_list",
+			"authentication_service", "external_ldap_user_domain"} {
+			entryPoints = append(entryPoints, map[string]string{"rel": rel, "href": f.url("/elements/" + rel)})
+		}
+		entryPoints = append(entryPoints, map[string]string{"rel": "logout", "href": f.url("/logout")})
+		f.writeJSON(w, http.StatusOK, map[string]interface{}{"entry_point": entryPoints})
+		return
+	}
+	if f.session == "" || r.Header.Get("Cookie") != f.session {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	router := mux.NewRouter()
+	router.HandleFunc("/logout", func(w http.ResponseWriter, r *http.Request) {
+		f.session = ""
+		w.WriteHeader(http.StatusNoContent)
+	}).Methods(http.MethodPut)
+	router.HandleFunc("/elements", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Etag", "etag")
+		f.writeJSON(w, http.StatusOK, map[string]interface{}{"result": []interface{}{}})
+	}).Methods(http.MethodGet)
+	router.HandleFunc("/elements/admin_user", f.listAdmins).Methods(http.MethodGet)
+	router.HandleFunc("/elements/admin_user", func(w http.ResponseWriter, r *http.Request) {
+		f.createAdmin(w, body)
+	}).Methods(http.MethodPost)
+	router.HandleFunc("/elements/admin_user/{key}", func(w http.ResponseWriter, r *http.Request) {
+		f.handleAdmin(w, r, body)
+	}).Methods(http.MethodGet, http.MethodPut, http.MethodDelete)
+	router.HandleFunc("/elements/admin_user/{key}/enable_disable", func(w http.ResponseWriter, r *http.Request) {
+		f.toggleAdmin(w, r)
+	}).Methods(http.MethodPut)
+	router.HandleFunc("/elements/role", f.listElements("role", "Viewer", "Editor", "Operator", "Owner",
+		"Superuser")).Methods(http.MethodGet)
+	router.HandleFunc("/elements/admin_domain", f.listElements("admin_domain", "Shared Domain",
+		"Branch Domain")).Methods(http.MethodGet)
+	router.HandleFunc("/elements/access_control_list", f.listElements("access_control_list",
+		"ALL Elements", "ALL Firewalls")).Methods(http.MethodGet)
+	router.HandleFunc("/elements/authentication_service", f.listElements("authentication_service",
+		"LDAP Authentication")).Methods(http.MethodGet)
+	router.HandleFunc("/elements/external_ldap_user_domain", f.listElements("external_ldap_user_domain",
+		"contoso")).Methods(http.MethodGet)
+	router.HandleFunc("/elements/external_ldap_user_domain/1/browse", func(w http.ResponseWriter, r *http.Request) {
+		f.writeJSON(w, http.StatusOK, map[string]interface{}{"result": []map[string]string{
+			{"name": viper.GetString("LDAP_USERS_OU"), "href": f.url("/ldap/users"), "type": "external_ldap_user_group"},
+		}})
+	}).Methods(http.MethodGet)
+	router.HandleFunc("/ldap/users/browse", f.browseLdapUsers).Methods(http.MethodGet)
+	r.URL.Path = path
+	router.ServeHTTP(w, r)
+}
+
+func (f *fakeSmc) listAdmins(w http.ResponseWriter, r *http.Request) {
+	result := []map[string]string{}
+	for key, admin := range f.admins {
+		result = append(result, map[string]string{"name": admin["name"].(string), "href": f.adminHref(key),
+			"type": "admin_user"})
+	}
+	f.writeJSON(w, http.StatusOK, map[string]interface{}{"result": result})
+}
+
+func (f *fakeSmc) createAdmin(w http.ResponseWriter, admin map[string]interface{}) {
+	name, _ := admin["name"].(string)
+	if _, ok := f.adminKey(name); ok || name == "" {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		return
+	}
+	key := f.nextKey
+	f.nextKey++
+	admin["key"] = key
+	f.admins[key] = admin
+	w.Header().Set("Location", f.adminHref(key))
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (f *fakeSmc) handleAdmin(w http.ResponseWriter, r *http.Request, body map[string]interface{}) {
+	key, _ := strconv.Atoi(mux.Vars(r)["key"])
+	admin, ok := f.admins[key]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		f.writeAdmin(w, key, admin)
+	case http.MethodPut:
+		body["key"] = key
+		f.admins[key] = body
+		f.writeAdmin(w, key, body)
+	case http.MethodDelete:
+		delete(f.admins, key)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (f *fakeSmc) toggleAdmin(w http.ResponseWriter, r *http.Request) {
+	key, _ := strconv.Atoi(mux.Vars(r)["key"])
+	admin, ok := f.admins[key]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	enabled, _ := admin["enabled"].(bool)
+	admin["enabled"] = !enabled
+	f.writeAdmin(w, key, admin)
+}
+
+func (f *fakeSmc) writeAdmin(w http.ResponseWriter, key int, admin map[string]interface{}) {
+	result := copyFakeAdmin(admin)
+	result["link"] = []map[string]string{{"rel": "self", "href": f.adminHref(key)}}
+	w.Header().Set("Etag", fmt.Sprintf("etag-%d", key))
+	f.writeJSON(w, http.StatusOK, result)
+}
+
+// list elements of a type, the href of each element ends with its position in the list
+func (f *fakeSmc) listElements(elementType string, names ...string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		result := []map[string]string{}
+		for i, name := range names {
+			result = append(result, map[string]string{"name": name, "type": elementType,
+				"href": f.url(fmt.Sprintf("/elements/%s/%d", elementType, i+1))})
+		}
+		f.writeJSON(w, http.StatusOK, map[string]interface{}{"result": result})
+	}
+}
+
+func (f *fakeSmc) browseLdapUsers(w http.ResponseWriter, r *http.Request) {
+	result := []map[string]string{}
+	for name, id := range f.ldapUsers {
+		result = append(result, map[string]string{"name": name, "href": f.url("/ldap/users/" + id),
+			"type": "external_ldap_user"})
+	}
+	f.writeJSON(w, http.StatusOK, map[string]interface{}{"result": result})
+}
+
+func (f *fakeSmc) writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+func copyFakeAdmin(admin map[string]interface{}) map[string]interface{} {
+	buffer, _ := json.Marshal(admin)
+	result := make(map[string]interface{})
+	json.Unmarshal(buffer, &result)
+	return result
+}
+
+// serve a request with the routes of the connector
+func serveConnector(method string, target string, body string) *httptest.ResponseRecorder {
+	request := httptest.NewRequest(method, target, strings.NewReader(body))
+	request.Header.Set("Content-Type", "application/scim+json")
+	return serveConnectorRequest(request)
+}
+
+func serveConnectorRequest(request *http.Request) *httptest.ResponseRecorder {
+	router := mux.NewRouter().StrictSlash(true)
+	for _, route := range append(Routes, scimRoutes()...) {
+		router.Methods(route.Method).Path(route.Pattern).Handler(route.HandlerFunc)
+	}
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+	return recorder
+}
@@ -0,0 +1,373 @@
+package cmd
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/spf13/viper"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the azure identity source, a Microsoft Graph client authenticated with the OAuth2 client credentials of an app
+// registration, using either a client secret or a certificate. users are identified by their mail nickname
+type GraphClient struct {
+	// the display name of the enterprise application the users are assigned to
+	AppName      string
+	GraphUrl     string
+	TokenUrl     string
+	ClientId     string
+	ClientSecret string
+	// the certificate registered for the app and its private key, used when no client secret is given
+	Certificate *x509.Certificate
+	PrivateKey  *rsa.PrivateKey
+	HttpClient  *http.Client
+	// the file the state of the delta queries is kept in between runs, the state is kept in memory only if empty
+	StateFile string
+
+	state    *graphDeltaState
+	syncedAt time.Time
+	// the object ids of the users by their lowercase mail nickname, and of the groups by their direct members
+	userIds     map[string]string
+	memberOf    map[string][]string
+	mu          sync.Mutex
+	accessToken string
+	expiresAt   time.Time
+}
+
+type graphPage struct {
+	Value    []map[string]interface{} `json:"value"`
+	NextLink string                   `json:"@odata.nextLink"`
+}
+
+// create a Graph client from the AZURE section of the config file
+func NewGraphClientFromConfig() (*GraphClient, error) {
+	tenantId := viper.GetString("AZURE.TENANT_ID")
+	clientId := viper.GetString("AZURE.CLIENT_ID")
+	if tenantId == "" || clientId == "" {
+		return nil, errors.New("the fields AZURE.TENANT_ID and AZURE.CLIENT_ID in the config file are required")
+	}
+	loginUrl := strings.TrimSuffix(viper.GetString("AZURE.LOGIN_URL"), "/")
+	client := &GraphClient{
+		AppName:      viper.GetString("APP_NAME"),
+		GraphUrl:     strings.TrimSuffix(viper.GetString("AZURE.GRAPH_URL"), "/"),
+		TokenUrl:     fmt.Sprintf("%s/%s/oauth2/v2.0/token", loginUrl, tenantId),
+		ClientId:     clientId,
+		ClientSecret: viper.GetString("AZURE.CLIENT_SECRET"),
+		HttpClient:   &http.Client{Timeout: 30 * time.Second},
+		StateFile:    viper.GetString("AZURE.SYNC_STATE_FILE"),
+	}
+	if client.ClientSecret != "" {
+		return client, nil
+	}
+	certificatePath := viper.GetString("AZURE.CERTIFICATE_PATH")
+	if certificatePath == "" {
+		return nil, errors.New("either AZURE.CLIENT_SECRET or AZURE.CERTIFICATE_PATH is required in the config file")
+	}
+	certificate, key, err := loadCertificate(certificatePath)
+	if err != nil {
+		return nil, err
+	}
+	client.Certificate = certificate
+	client.PrivateKey = key
+	return client, nil
+}
+
+// load a PEM file holding the certificate of the app and its RSA private key
+func loadCertificate(path string) (*x509.Certificate, *rsa.PrivateKey, error) {
+	buff, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	var certificate *x509.Certificate
+	var key *rsa.PrivateKey
+	for block, rest := pem.Decode(buff); block != nil; block, rest = pem.Decode(rest) {
+		switch block.Type {
+		case "CERTIFICATE":
+			if certificate, err = x509.ParseCertificate(block.Bytes); err != nil {
+				return nil, nil, err
+			}
+		case "RSA PRIVATE KEY":
+			if key, err = x509.ParsePKCS1PrivateKey(block.Bytes); err != nil {
+				return nil, nil, err
+			}
+		case "PRIVATE KEY":
+			parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+			if err != nil {
+				return nil, nil, err
+			}
+			rsaKey, ok := parsed.(*rsa.PrivateKey)
+			if !ok {
+				return nil, nil, errors.New("only RSA private keys are supported")
+			}
+			key = rsaKey
+		}
+	}
+	if certificate == nil || key == nil {
+		return nil, nil, fmt.Errorf("the file %s must contain a certificate and its private key", path)
+	}
+	return certificate, key, nil
+}
+
+// Graph has no delta query for the app role assignments, they are listed in pages of up to 999 assignments. their
+// users and groups are resolved from the users and groups synced by delta queries, users and groups missing from the
+// sync are read one by one. the users of the groups assigned to the app are assigned too, including the users of
+// nested groups
+func (g *GraphClient) AssignedUserNames() ([]string, error) {
+	if err := g.sync(); err != nil {
+		return nil, err
+	}
+	appName := g.AppName
+	appId, err := g.servicePrincipalId(appName)
+	if err != nil {
+		return nil, err
+	}
+	assignments, err := g.getAll(fmt.Sprintf(
+		"/v1.0/servicePrincipals/%s/appRoleAssignedTo?$select=principalId,principalType&$top=999", url.PathEscape(appId)))
+	if isGraphStatus(err, http.StatusNotFound) {
+		// the app is recreated, look it up again in the next sync
+		delete(g.state.ServicePrincipals, appName)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	assigned := make(map[string]bool)
+	addName := func(name string) {
+		if name != "" && !assigned[strings.ToLower(name)] {
+			assigned[strings.ToLower(name)] = true
+			names = append(names, name)
+		}
+	}
+	for _, assignment := range assignments {
+		principalId, _ := assignment["principalId"].(string)
+		switch assignment["principalType"] {
+		case "User":
+			name, ok := g.state.Users[principalId]
+			if !ok {
+				var user struct {
+					MailNickname string `json:"mailNickname"`
+				}
+				if err := g.get(fmt.Sprintf("%s/v1.0/users/%s?$select=mailNickname", g.GraphUrl,
+					url.PathEscape(principalId)), &user); err != nil {
+					return nil, err
+				}
+				name = user.MailNickname
+			}
+			addName(name)
+		case "Group":
+			if _, ok := g.state.Groups[principalId]; ok {
+				g.groupUserNames(principalId, make(map[string]bool), addName)
+				continue
+			}
+			members, err := g.getAll(fmt.Sprintf(
+				"/v1.0/groups/%s/transitiveMembers/microsoft.graph.user?$select=id,mailNickname",
+				url.PathEscape(principalId)))
+			if err != nil {
+				return nil, err
+			}
+			for _, member := range members {
+				name, _ := member["mailNickname"].(string)
+				addName(name)
+			}
+		}
+	}
+	return names, nil
+}
+
+// add the users of a synced group and of its nested groups
+func (g *GraphClient) groupUserNames(id string, visited map[string]bool, add func(string)) {
+	if visited[id] {
+		return
+	}
+	visited[id] = true
+	for member := range g.state.Groups[id].Members {
+		if _, ok := g.state.Groups[member]; ok {
+			g.groupUserNames(member, visited, add)
+		} else {
+			add(g.state.Users[member])
+		}
+	}
+}
+
+func (g *GraphClient) UserExists(name string) (bool, error) {
+	id, err := g.userId(name)
+	return id != "", err
+}
+
+// the groups the user is a direct member of, from the synced groups
+func (g *GraphClient) UserGroups(name string) ([]IdentityGroup, error) {
+	id, err := g.userId(name)
+	if err != nil || id == "" {
+		return nil, err
+	}
+	var groups []IdentityGroup
+	for _, groupId := range g.memberOf[id] {
+		groups = append(groups, IdentityGroup{Id: groupId, Name: g.state.Groups[groupId].Name})
+	}
+	return groups, nil
+}
+
+// find the object id of a user by its mail nickname, the id is empty for unknown users
+func (g *GraphClient) userId(name string) (string, error) {
+	if err := g.sync(); err != nil {
+		return "", err
+	}
+	return g.userIds[strings.ToLower(name)], nil
+}
+
+// find the object id of the service principal of an app, the id is kept in the sync state once found
+func (g *GraphClient) servicePrincipalId(appName string) (string, error) {
+	if id, ok := g.state.ServicePrincipals[appName]; ok {
+		return id, nil
+	}
+	query := url.Values{}
+	query.Set("$filter", fmt.Sprintf("displayName eq '%s'", strings.ReplaceAll(appName, "'", "''")))
+	query.Set("$select", "id")
+	servicePrincipals, err := g.getAll("/v1.0/servicePrincipals?" + query.Encode())
+	if err != nil {
+		return "", err
+	}
+	if len(servicePrincipals) == 0 {
+		return "", fmt.Errorf("the app %s is not found in azure", appName)
+	}
+	id, _ := servicePrincipals[0]["id"].(string)
+	g.state.ServicePrincipals[appName] = id
+	return id, g.state.save(g.StateFile)
+}
+
+// read all pages of a Graph collection
+func (g *GraphClient) getAll(path string) ([]map[string]interface{}, error) {
+	var values []map[string]interface{}
+	for next := g.GraphUrl + path; next != ""; {
+		var page graphPage
+		if err := g.get(next, &page); err != nil {
+			return nil, err
+		}
+		values = append(values, page.Value...)
+		next = page.NextLink
+	}
+	return values, nil
+}
+
+func (g *GraphClient) get(requestUrl string, result interface{}) error {
+	token, err := g.token()
+	if err != nil {
+		return err
+	}
+	request, err := http.NewRequest("GET", requestUrl, nil)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Authorization", "Bearer "+token)
+	request.Header.Set("Accept", "application/json")
+	response, err := g.HttpClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	buff, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return err
+	}
+	if response.StatusCode != http.StatusOK {
+		if response.StatusCode == http.StatusUnauthorized {
+			g.mu.Lock()
+			g.accessToken = ""
+			g.mu.Unlock()
+		}
+		return &graphStatusError{status: response.StatusCode, body: string(buff)}
+	}
+	return json.Unmarshal(buff, result)
+}
+
+// get an access token for Microsoft Graph, tokens are reused until shortly before they expire
+func (g *GraphClient) token() (string, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.accessToken != "" && time.Now().Before(g.expiresAt) {
+		return g.accessToken, nil
+	}
+	form := url.Values{}
+	form.Set("grant_type", "client_credentials")
+	form.Set("client_id", g.ClientId)
+	form.Set("scope", g.GraphUrl+"/.default")
+	if g.ClientSecret != "" {
+		form.Set("client_secret", g.ClientSecret)
+	} else {
+		assertion, err := g.clientAssertion()
+		if err != nil {
+			return "", err
+		}
+		form.Set("client_assertion_type", "urn:ietf:params:oauth:client-assertion-type:jwt-bearer")
+		form.Set("client_assertion", assertion)
+	}
+	response, err := g.HttpClient.PostForm(g.TokenUrl, form)
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+	var result struct {
+		AccessToken      string `json:"access_token"`
+		ExpiresIn        int    `json:"expires_in"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&result); err != nil {
+		return "", err
+	}
+	if response.StatusCode != http.StatusOK || result.AccessToken == "" {
+		return "", fmt.Errorf("failed in getting an access token for Microsoft Graph: %s", result.ErrorDescription)
+	}
+	g.accessToken = result.AccessToken
+	g.expiresAt = time.Now().Add(time.Duration(result.ExpiresIn)*time.Second - time.Minute)
+	return g.accessToken, nil
+}
+
+// build the signed JWT proving the possession of the certificate of the app
+func (g *GraphClient) clientAssertion() (string, error) {
+	thumbprint := sha1.Sum(g.Certificate.Raw)
+	header, err := json.Marshal(map[string]string{
+		"alg": "RS256",
+		"typ": "JWT",
+		"x5t": base64.RawURLEncoding.EncodeToString(thumbprint[:]),
+	})
+	if err != nil {
+		return "", err
+	}
+	jti := make([]byte, 16)
+	if _, err := rand.Read(jti); err != nil {
+		return "", err
+	}
+	now := time.Now().Unix()
+	claims, err := json.Marshal(map[string]interface{}{
+		"aud": g.TokenUrl,
+		"iss": g.ClientId,
+		"sub": g.ClientId,
+		"jti": hex.EncodeToString(jti),
+		"nbf": now,
+		"exp": now + 600,
+	})
+	if err != nil {
+		return "", err
+	}
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	hash := sha256.Sum256([]byte(unsigned))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, g.PrivateKey, crypto.SHA256, hash[:])
+	if err != nil {
+		return "", err
+	}
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
@@ -0,0 +1,407 @@
+package cmd
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// a fake Microsoft Graph serving fixed JSON responses, or a status given as an int, by path, with the query of the
+// request. the requests are counted by path and must carry the token issued by the token endpoint
+type fakeGraph struct {
+	server *httptest.Server
+
+	// the certificate of the app, the client assertions are checked against it
+	certificate *x509.Certificate
+
+	mu        sync.Mutex
+	responses map[string]interface{}
+	requests  map[string]int
+}
+
+func newFakeGraph() *fakeGraph {
+	f := &fakeGraph{responses: make(map[string]interface{}), requests: make(map[string]int)}
+	f.server = httptest.NewServer(http.HandlerFunc(f.serve))
+	return f
+}
+
+func (f *fakeGraph) Close() {
+	f.server.Close()
+}
+
+// a client of the fake Graph authenticated with a client secret
+func (f *fakeGraph) client() *GraphClient {
+	return &GraphClient{
+		AppName:      "SMC",
+		GraphUrl:     f.server.URL,
+		TokenUrl:     f.server.URL + "/token",
+		ClientId:     "client",
+		ClientSecret: "secret",
+		HttpClient:   f.server.Client(),
+	}
+}
+
+// answer the requests on a path, with its query when given, with a JSON body
+func (f *fakeGraph) respond(pathAndQuery string, body interface{}) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.responses[pathAndQuery] = body
+}
+
+func (f *fakeGraph) count(path string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.requests[path]
+}
+
+func (f *fakeGraph) serve(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests[r.URL.Path]++
+	if r.URL.Path == "/token" {
+		if r.PostFormValue("client_secret") != "secret" && !f.validClientAssertion(r.PostFormValue("client_assertion")) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"access_token": "token", "expires_in": 3600})
+		return
+	}
+	if r.Header.Get("Authorization") != "Bearer token" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	body, ok := f.responses[r.URL.Path+"?"+r.URL.RawQuery]
+	if !ok {
+		body, ok = f.responses[r.URL.Path]
+	}
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if status, ok := body.(int); ok {
+		w.WriteHeader(status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(body)
+}
+
+// check the signature and the claims of a JWT signed with the certificate of the app
+func (f *fakeGraph) validClientAssertion(assertion string) bool {
+	parts := strings.Split(assertion, ".")
+	if f.certificate == nil || len(parts) != 3 {
+		return false
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+	hash := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	publicKey := f.certificate.PublicKey.(*rsa.PublicKey)
+	if rsa.VerifyPKCS1v15(publicKey, crypto.SHA256, hash[:], signature) != nil {
+		return false
+	}
+	buff, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return false
+	}
+	var claims struct {
+		Aud string `json:"aud"`
+		Iss string `json:"iss"`
+		Exp int64  `json:"exp"`
+	}
+	return json.Unmarshal(buff, &claims) == nil && claims.Aud == f.server.URL+"/token" && claims.Iss == "client" &&
+		claims.Exp > time.Now().Unix()
+}
+
+// a page of a Graph collection
+func graphValues(values ...map[string]interface{}) map[string]interface{} {
+	return map[string]interface{}{"value": values}
+}
+
+// a fake Graph with the users alice, bob, carol and dave, the groups admins holding alice and the nested group
+// operators, operators holding bob, and the app SMC
+func newFakeGraphDirectory() *fakeGraph {
+	f := newFakeGraph()
+	f.respond("/v1.0/users/delta", map[string]interface{}{
+		"value": []map[string]interface{}{
+			{"id": "u1", "mailNickname": "alice"},
+			{"id": "u2", "mailNickname": "bob"},
+			{"id": "u3", "mailNickname": "carol"},
+			{"id": "u4", "mailNickname": "dave"},
+		},
+		"@odata.deltaLink": f.server.URL + "/v1.0/users/delta?$deltatoken=1",
+	})
+	f.respond("/v1.0/groups/delta", map[string]interface{}{
+		"value": []map[string]interface{}{
+			{"id": "g2", "displayName": "admins", "members@delta": []map[string]interface{}{
+				{"@odata.type": "#microsoft.graph.user", "id": "u1"},
+				{"@odata.type": "#microsoft.graph.group", "id": "g3"},
+			}},
+			{"id": "g3", "displayName": "operators", "members@delta": []map[string]interface{}{
+				{"@odata.type": "#microsoft.graph.user", "id": "u2"},
+			}},
+		},
+		"@odata.deltaLink": f.server.URL + "/v1.0/groups/delta?$deltatoken=1",
+	})
+	f.respond("/v1.0/servicePrincipals", graphValues(map[string]interface{}{"id": "sp1"}))
+	return f
+}
+
+func TestGraphClient(t *testing.T) {
+	f := newFakeGraphDirectory()
+	defer f.Close()
+	f.respond("/v1.0/servicePrincipals/sp1/appRoleAssignedTo", graphValues(
+		map[string]interface{}{"principalId": "u1", "principalType": "User"},
+		map[string]interface{}{"principalId": "u3", "principalType": "User"},
+		map[string]interface{}{"principalId": "sp2", "principalType": "ServicePrincipal"},
+	))
+	client := f.client()
+
+	names, err := client.AssignedUserNames()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(names)
+	if got := strings.Join(names, ","); got != "alice,carol" {
+		t.Errorf("got the assigned users %s, want alice,carol", got)
+	}
+	for name, want := range map[string]bool{"bob": true, "Dave": true, "erin": false} {
+		if exists, err := client.UserExists(name); err != nil || exists != want {
+			t.Errorf("got %t, %v for the user %s, want %t", exists, err, name, want)
+		}
+	}
+	// the access token is reused
+	if tokens := f.count("/token"); tokens != 1 {
+		t.Errorf("got %d token requests, want 1", tokens)
+	}
+
+	client.ClientSecret = "revoked"
+	client.accessToken = ""
+	if _, err := client.AssignedUserNames(); err == nil {
+		t.Error("reading the users succeeded with a revoked client secret")
+	}
+}
+
+func TestGraphAssignedUserNames(t *testing.T) {
+	f := newFakeGraphDirectory()
+	defer f.Close()
+	f.respond("/v1.0/servicePrincipals/sp1/appRoleAssignedTo", graphValues(
+		map[string]interface{}{"principalId": "u1", "principalType": "User"},
+		map[string]interface{}{"principalId": "g1", "principalType": "Group"},
+		map[string]interface{}{"principalId": "sp2", "principalType": "ServicePrincipal"},
+	))
+	// the group is created after the sync, its members are given in two pages. alice is assigned directly and by the
+	// group
+	f.respond("/v1.0/groups/g1/transitiveMembers/microsoft.graph.user", map[string]interface{}{
+		"value": []map[string]interface{}{
+			{"id": "u1", "mailNickname": "alice"},
+			{"id": "u2", "mailNickname": "bob"},
+		},
+		"@odata.nextLink": f.server.URL + "/v1.0/groups/g1/transitiveMembers/microsoft.graph.user?$skiptoken=2",
+	})
+	f.respond("/v1.0/groups/g1/transitiveMembers/microsoft.graph.user?$skiptoken=2",
+		graphValues(map[string]interface{}{"id": "u3", "mailNickname": "carol"}))
+
+	names, err := f.client().AssignedUserNames()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(names)
+	if got := strings.Join(names, ","); got != "alice,bob,carol" {
+		t.Errorf("got the assigned users %s, want alice,bob,carol", got)
+	}
+}
+
+func TestGraphAssignedUserNamesOfSyncedGroups(t *testing.T) {
+	f := newFakeGraphDirectory()
+	defer f.Close()
+	f.respond("/v1.0/servicePrincipals/sp1/appRoleAssignedTo", graphValues(
+		map[string]interface{}{"principalId": "g2", "principalType": "Group"},
+		map[string]interface{}{"principalId": "u3", "principalType": "User"},
+	))
+
+	names, err := f.client().AssignedUserNames()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(names)
+	if got := strings.Join(names, ","); got != "alice,bob,carol" {
+		t.Errorf("got the assigned users %s, want alice,bob,carol", got)
+	}
+	for _, path := range []string{"/v1.0/groups/g2/transitiveMembers/microsoft.graph.user", "/v1.0/users/u3"} {
+		if count := f.count(path); count != 0 {
+			t.Errorf("got %d requests of %s, want none", count, path)
+		}
+	}
+}
+
+func TestGraphDeltaSync(t *testing.T) {
+	dir, err := ioutil.TempDir("", "graph-sync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	f := newFakeGraphDirectory()
+	defer f.Close()
+	client := f.client()
+	client.StateFile = filepath.Join(dir, "graph_sync_state.json")
+	userGroups := func(client *GraphClient, name string) string {
+		groups, err := client.UserGroups(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, group := range groups {
+			names = append(names, group.Name)
+		}
+		sort.Strings(names)
+		return strings.Join(names, ",")
+	}
+
+	if got := userGroups(client, "Alice"); got != "admins" {
+		t.Errorf("got the groups %q of alice, want admins", got)
+	}
+	if got := userGroups(client, "bob"); got != "operators" {
+		t.Errorf("got the groups %q of bob, want operators", got)
+	}
+	// bob is renamed to robert and leaves operators, dave is deleted, carol joins admins and operators is deleted
+	f.respond("/v1.0/users/delta?$deltatoken=1", map[string]interface{}{
+		"value": []map[string]interface{}{
+			{"id": "u2", "mailNickname": "robert"},
+			{"id": "u4", "@removed": map[string]interface{}{"reason": "changed"}},
+		},
+		"@odata.deltaLink": f.server.URL + "/v1.0/users/delta?$deltatoken=2",
+	})
+	f.respond("/v1.0/groups/delta?$deltatoken=1", map[string]interface{}{
+		"value": []map[string]interface{}{
+			{"id": "g3", "members@delta": []map[string]interface{}{
+				{"id": "u2", "@removed": map[string]interface{}{"reason": "deleted"}},
+			}},
+			{"id": "g2", "members@delta": []map[string]interface{}{{"id": "u3"}}},
+			{"id": "g3", "@removed": map[string]interface{}{"reason": "changed"}},
+		},
+		"@odata.deltaLink": f.server.URL + "/v1.0/groups/delta?$deltatoken=2",
+	})
+	// a new client starts from the state file
+	client = f.client()
+	client.StateFile = filepath.Join(dir, "graph_sync_state.json")
+	for name, want := range map[string]string{"alice": "admins", "carol": "admins", "robert": "", "bob": ""} {
+		if got := userGroups(client, name); got != want {
+			t.Errorf("got the groups %q of %s, want %q", got, name, want)
+		}
+	}
+	for name, want := range map[string]bool{"robert": true, "bob": false, "dave": false} {
+		if exists, err := client.UserExists(name); err != nil || exists != want {
+			t.Errorf("got %t, %v for the user %s, want %t", exists, err, name, want)
+		}
+	}
+	// the full queries are done once, the second sync reads the changes only
+	for _, path := range []string{"/v1.0/users/delta", "/v1.0/groups/delta"} {
+		if count := f.count(path); count != 2 {
+			t.Errorf("got %d requests of %s, want 2", count, path)
+		}
+	}
+	if count := f.count("/v1.0/users/u1/memberOf"); count != 0 {
+		t.Errorf("got %d requests of the groups of a user, want none", count)
+	}
+
+	// the groups are synced again when Graph expires their delta link, the users are not
+	f.respond("/v1.0/users/delta?$deltatoken=2", map[string]interface{}{
+		"value":            []map[string]interface{}{},
+		"@odata.deltaLink": f.server.URL + "/v1.0/users/delta?$deltatoken=2",
+	})
+	f.respond("/v1.0/groups/delta?$deltatoken=2", http.StatusGone)
+	client.syncedAt = time.Time{}
+	// the full sync returns the initial groups, robert is bob renamed
+	if got := userGroups(client, "robert"); got != "operators" {
+		t.Errorf("got the groups %q of robert after a full sync of the groups, want operators", got)
+	}
+	if count := f.count("/v1.0/users/delta"); count != 3 {
+		t.Errorf("got %d requests of the users delta, want 3", count)
+	}
+}
+
+func TestDetectDeletedUsersKeepsGroupAssignedUsers(t *testing.T) {
+	f := newFakeGraphDirectory()
+	defer f.Close()
+	f.respond("/v1.0/servicePrincipals/sp1/appRoleAssignedTo", graphValues(
+		map[string]interface{}{"principalId": "g1", "principalType": "Group"},
+	))
+	f.respond("/v1.0/groups/g1/transitiveMembers/microsoft.graph.user",
+		graphValues(map[string]interface{}{"id": "u1", "mailNickname": "alice"}))
+	smc := newFakeSmc(t)
+	defer smc.Close()
+	smc.addAdmin("alice", true)
+	smc.addAdmin("bob", true)
+	smc.addAdmin("erin", true)
+
+	if err := DetectDeletedUsers(context.Background(), f.client()); err != nil {
+		t.Fatal(err)
+	}
+	// bob is no longer assigned, erin is not known to azure
+	for name, exists := range map[string]bool{"alice": true, "bob": false, "erin": true} {
+		if (smc.admin(name) != nil) != exists {
+			t.Errorf("the admin %s exists=%t, want %t", name, !exists, exists)
+		}
+	}
+}
+
+func TestGraphClientCertificate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "graph-certificate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "connector"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the certificate and its key in a single PEM file, as exported for the app registration
+	buff := append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})...)
+	certificatePath := writeTestFile(t, dir, "app.pem", buff)
+	f := newFakeGraphDirectory()
+	defer f.Close()
+
+	client := f.client()
+	client.ClientSecret = ""
+	if client.Certificate, client.PrivateKey, err = loadCertificate(certificatePath); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.UserExists("alice"); err == nil {
+		t.Error("got an access token with a certificate unknown to azure")
+	}
+	f.certificate = client.Certificate
+	if exists, err := client.UserExists("alice"); err != nil || !exists {
+		t.Errorf("got %t, %v for the user alice, want true", exists, err)
+	}
+}
@@ -0,0 +1,269 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// the users and groups of the directory as known from the last Graph delta queries. the state is persisted between
+// runs, so each sync only reads the users and groups changed since the previous one
+type graphDeltaState struct {
+	// the link returned by the last delta query of the users, empty until the first full sync is done
+	DeltaLink string `json:"deltaLink"`
+	// the mail nicknames of the users by their object id
+	Users map[string]string `json:"users"`
+	// the link returned by the last delta query of the groups, empty until the first full sync is done
+	GroupsDeltaLink string `json:"groupsDeltaLink"`
+	// the groups by their object id
+	Groups map[string]*graphGroup `json:"groups"`
+	// the object ids of the service principals by their display name
+	ServicePrincipals map[string]string `json:"servicePrincipals"`
+}
+
+// a group with the object ids of its direct members, users and nested groups
+type graphGroup struct {
+	Name    string          `json:"name"`
+	Members map[string]bool `json:"members"`
+}
+
+type graphDeltaPage struct {
+	Value     []map[string]interface{} `json:"value"`
+	NextLink  string                   `json:"@odata.nextLink"`
+	DeltaLink string                   `json:"@odata.deltaLink"`
+}
+
+// a failed Graph request
+type graphStatusError struct {
+	status int
+	body   string
+}
+
+func (e *graphStatusError) Error() string {
+	return fmt.Sprintf("unexpected http status %d received from Microsoft Graph: %s", e.status, e.body)
+}
+
+func newGraphDeltaState() *graphDeltaState {
+	return &graphDeltaState{
+		Users:             make(map[string]string),
+		Groups:            make(map[string]*graphGroup),
+		ServicePrincipals: make(map[string]string),
+	}
+}
+
+// load the persisted delta state, a missing or broken state file starts a full sync
+func loadGraphDeltaState(path string) *graphDeltaState {
+	state := newGraphDeltaState()
+	if path == "" {
+		return state
+	}
+	buff, err := ioutil.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logrus.Errorf("failed in reading the Graph sync state, all users and groups are synced again: %s", err)
+		}
+		return state
+	}
+	if err := json.Unmarshal(buff, state); err != nil {
+		logrus.Errorf("failed in reading the Graph sync state, all users and groups are synced again: %s", err)
+		return newGraphDeltaState()
+	}
+	if state.Users == nil {
+		state.Users = make(map[string]string)
+	}
+	if state.Groups == nil {
+		state.Groups = make(map[string]*graphGroup)
+	}
+	for _, group := range state.Groups {
+		if group.Members == nil {
+			group.Members = make(map[string]bool)
+		}
+	}
+	if state.ServicePrincipals == nil {
+		state.ServicePrincipals = make(map[string]string)
+	}
+	return state
+}
+
+// write the state to a temporary file first, so a crash never leaves a partial state behind
+func (s *graphDeltaState) save(path string) error {
+	if path == "" {
+		return nil
+	}
+	buff, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(buff); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// the users and groups synced by the last delta queries are used without a new query during this period
+const graphSyncInterval = time.Minute
+
+// apply the users and groups changed since the last sync. the first sync, and a sync after Graph expired a delta link,
+// reads all users or groups
+func (g *GraphClient) sync() error {
+	if g.state == nil {
+		g.state = loadGraphDeltaState(g.StateFile)
+		g.indexState()
+	}
+	if time.Since(g.syncedAt) < graphSyncInterval {
+		return nil
+	}
+	err := g.readUsersDelta()
+	if isGraphStatus(err, http.StatusGone) {
+		logrus.Info("the Graph delta link of the users is expired, all users are synced again")
+		g.state.DeltaLink = ""
+		g.state.Users = make(map[string]string)
+		err = g.readUsersDelta()
+	}
+	if err == nil {
+		err = g.readGroupsDelta()
+		if isGraphStatus(err, http.StatusGone) {
+			logrus.Info("the Graph delta link of the groups is expired, all groups are synced again")
+			g.state.GroupsDeltaLink = ""
+			g.state.Groups = make(map[string]*graphGroup)
+			err = g.readGroupsDelta()
+		}
+	}
+	// the changes read so far are applied even if a query failed
+	g.indexState()
+	if err != nil {
+		return err
+	}
+	g.syncedAt = time.Now()
+	return g.state.save(g.StateFile)
+}
+
+func isGraphStatus(err error, status int) bool {
+	statusError, ok := err.(*graphStatusError)
+	return ok && statusError.status == status
+}
+
+// index the users by their mail nickname and the groups by their direct members
+func (g *GraphClient) indexState() {
+	g.userIds = make(map[string]string, len(g.state.Users))
+	for id, nickname := range g.state.Users {
+		g.userIds[strings.ToLower(nickname)] = id
+	}
+	g.memberOf = make(map[string][]string)
+	for id, group := range g.state.Groups {
+		for member := range group.Members {
+			g.memberOf[member] = append(g.memberOf[member], id)
+		}
+	}
+}
+
+func (g *GraphClient) readUsersDelta() error {
+	next := g.state.DeltaLink
+	if next == "" {
+		next = g.GraphUrl + "/v1.0/users/delta?$select=mailNickname"
+	}
+	// changes are collected first, an interrupted sync is read again from the same delta link
+	// the last change of each user wins, removed users are mapped to nil
+	changes := make(map[string]*string)
+	deltaLink := g.state.DeltaLink
+	for next != "" {
+		var page graphDeltaPage
+		if err := g.get(next, &page); err != nil {
+			return err
+		}
+		for _, user := range page.Value {
+			id, _ := user["id"].(string)
+			if _, ok := user["@removed"]; ok {
+				changes[id] = nil
+				continue
+			}
+			if name, ok := user["mailNickname"].(string); ok {
+				changes[id] = &name
+			}
+		}
+		next = page.NextLink
+		if page.DeltaLink != "" {
+			deltaLink = page.DeltaLink
+		}
+	}
+	g.state.DeltaLink = deltaLink
+	for id, name := range changes {
+		if name == nil {
+			delete(g.state.Users, id)
+		} else {
+			g.state.Users[id] = *name
+		}
+	}
+	if len(changes) != 0 {
+		logrus.Debugf("Graph users synced: %d changed", len(changes))
+	}
+	return nil
+}
+
+func (g *GraphClient) readGroupsDelta() error {
+	next := g.state.GroupsDeltaLink
+	if next == "" {
+		next = g.GraphUrl + "/v1.0/groups/delta?$select=displayName,members"
+	}
+	// the changes are applied in the order they are read once the delta link is reached, the members of a group can
+	// be spread over several changes
+	var changes []map[string]interface{}
+	deltaLink := g.state.GroupsDeltaLink
+	for next != "" {
+		var page graphDeltaPage
+		if err := g.get(next, &page); err != nil {
+			return err
+		}
+		changes = append(changes, page.Value...)
+		next = page.NextLink
+		if page.DeltaLink != "" {
+			deltaLink = page.DeltaLink
+		}
+	}
+	g.state.GroupsDeltaLink = deltaLink
+	for _, change := range changes {
+		id, _ := change["id"].(string)
+		if _, ok := change["@removed"]; ok {
+			delete(g.state.Groups, id)
+			continue
+		}
+		group, ok := g.state.Groups[id]
+		if !ok {
+			group = &graphGroup{Members: make(map[string]bool)}
+			g.state.Groups[id] = group
+		}
+		if name, ok := change["displayName"].(string); ok {
+			group.Name = name
+		}
+		members, _ := change["members@delta"].([]interface{})
+		for _, value := range members {
+			member, _ := value.(map[string]interface{})
+			memberId, _ := member["id"].(string)
+			if _, ok := member["@removed"]; ok {
+				delete(group.Members, memberId)
+			} else if memberId != "" {
+				group.Members[memberId] = true
+			}
+		}
+	}
+	if len(changes) != 0 {
+		logrus.Debugf("Graph groups synced: %d changed", len(changes))
+	}
+	return nil
+}
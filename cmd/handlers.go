@@ -17,11 +17,6 @@ type foundUsers struct {
 	Users      []UserInfo `json:"users"`
 }
 
-type ErrorTemplate struct {
-	ErrorCode int    `json:"error_code"`
-	Message   string `json:"message"`
-}
-
 type Operation struct {
 	Op    string      `json:"op"`
 	Path  string      `json:"path"`
@@ -32,35 +27,66 @@ type Operation struct {
 func GetUsers(w http.ResponseWriter, r *http.Request) {
 	args := r.URL.Query()
 	var userName string
-	var smcUsers foundUsers
-	var userScim []map[string]interface{}
+	var filter scimFilter
 	if filterQuery, ok := args["id"]; ok {
 		userName = filterQuery[0]
 	} else {
 		userName = ""
 	}
-	users, err := SmcUsers(userName)
+	if filterQuery := args.Get("filter"); filterQuery != "" {
+		var err error
+		filter, err = parseScimFilter(filterQuery)
+		if err != nil {
+			loggerWithField(r).Error(err.Error())
+			handleScimError(w, r, err)
+			return
+		}
+		if name, ok := filterUserName(filter); ok && userName == "" {
+			// the admin found by its name is the only match of the filter
+			userName = name
+			filter = nil
+		} else {
+			normalizeUserNameFilter(filter)
+		}
+	}
+	startIndex, count, err := scimPagination(r)
 	if err != nil {
 		loggerWithField(r).Error(err.Error())
+		handleScimError(w, r, err)
+		return
 	}
-	if users == nil {
-		smcUsers = foundUsers{
-			TotalUsers: 0,
-			Users:      nil,
-		}
-	} else {
-		usersInfo, err := SmcUsersWithDetails(users)
-		if err != nil {
-			loggerWithField(r).Error(err.Error())
+	var match func(UserInfo) (bool, error)
+	if filter != nil {
+		match = func(u UserInfo) (bool, error) {
+			return matchScimUser(filter, userScimInfo(foundUsers{Users: []UserInfo{u}})[0]), nil
 		}
-		smcUsers = foundUsers{TotalUsers: len(usersInfo), Users: usersInfo}
-		userScim = userScimInfo(smcUsers)
+	}
+	lookup := SmcUsers
+	if _, ok := args["id"]; !ok {
+		// the name of a filter is not looked up as an LDAP unique ID
+		lookup = SmcUsersByName
+	}
+	users, err := lookup(r.Context(), userName)
+	if err != nil {
+		loggerWithField(r).Error(err.Error())
+		handleScimError(w, r, err)
+		return
+	}
+	usersInfo, total, err := pageSmcUsers(r.Context(), users, match, startIndex, count)
+	if err != nil {
+		loggerWithField(r).Error(err.Error())
+		handleScimError(w, r, err)
+		return
+	}
+	userScim := userScimInfo(foundUsers{TotalUsers: len(usersInfo), Users: usersInfo})
+	if userScim == nil {
+		userScim = []map[string]interface{}{}
 	}
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
-	err = json.NewEncoder(w).Encode(&userScim)
+	err = json.NewEncoder(w).Encode(scimListResponse(total, startIndex, userScim, len(userScim)))
 	if err != nil {
-		loggerWithField(r).Fatal(err.Error())
+		loggerWithField(r).Error(err.Error())
 	}
 	loggerWithField(r).Infof("Get users")
 	return
@@ -97,7 +123,7 @@ func TokenPermission(w http.ResponseWriter, r *http.Request) {
 		result["reason"] = "The product name is not valid"
 		err := json.NewEncoder(w).Encode(result)
 		if err != nil {
-			loggerWithField(r).Fatal(err.Error())
+			loggerWithField(r).Error(err.Error())
 		}
 		return
 	}
@@ -109,12 +135,12 @@ func TokenPermission(w http.ResponseWriter, r *http.Request) {
 		result["reason"] = "The given password is not valid"
 		err := json.NewEncoder(w).Encode(result)
 		if err != nil {
-			loggerWithField(r).Fatal(err.Error())
+			loggerWithField(r).Error(err.Error())
 		}
 		return
 	}
 	//chick of user exists in SMC
-	validUser, err := validateUser(userInfo.UserName)
+	validUser, err := validateUser(r.Context(), userInfo.UserName)
 	if err != nil {
 		loggerWithField(r).Error(err.Error())
 		if !validUser {
@@ -123,7 +149,7 @@ func TokenPermission(w http.ResponseWriter, r *http.Request) {
 			result["reason"] = err.Error()
 			err := json.NewEncoder(w).Encode(result)
 			if err != nil {
-				loggerWithField(r).Fatal(err.Error())
+				loggerWithField(r).Error(err.Error())
 			}
 			return
 		}
@@ -131,7 +157,7 @@ func TokenPermission(w http.ResponseWriter, r *http.Request) {
 	result["allow"] = "true"
 	err = json.NewEncoder(w).Encode(result)
 	if err != nil {
-		loggerWithField(r).Fatal(err.Error())
+		loggerWithField(r).Error(err.Error())
 	}
 	loggerWithField(r).Infof("Give permission for getting an access token for user: %s", userInfo.UserName)
 }
@@ -153,6 +179,7 @@ func userScimInfo(users foundUsers) []map[string]interface{} {
 		userMap := make(map[string]interface{})
 		userMap["active"] = u.Enable
 		userMap["name"] = u.Name
+		userMap["userName"] = u.Name
 		userMap["id"] = userId
 		userList = append(userList, userMap)
 	}
@@ -167,28 +194,28 @@ func AddUser(w http.ResponseWriter, r *http.Request) {
 	}{}
 	if err := json.NewDecoder(r.Body).Decode(&userInfo); err != nil {
 		loggerWithField(r).Error(err.Error())
+		handleScimError(w, r, invalidSyntaxError("%s", err.Error()))
+		return
 	}
 	userName, err := lib.ExtractName(userInfo.LoginName)
-	if err != nil {
-		logrus.Fatal(err)
-	}
-	userALDAPurl, httpStatus, err := CreateUser(userName, userInfo.Active)
 	if err != nil {
 		loggerWithField(r).Error(err.Error())
-		w.WriteHeader(httpStatus)
+		handleScimError(w, r, invalidValueError("%s", err.Error()))
 		return
 	}
-	if httpStatus != http.StatusCreated {
-		w.WriteHeader(httpStatus)
+	userALDAPurl, err := CreateUser(r.Context(), userName, userInfo.Active)
+	if err != nil {
+		loggerWithField(r).Error(err.Error())
+		handleScimError(w, r, err)
 		return
 	}
 	responseBody := make(map[string]string)
 	responseBody["userUrl"] = userALDAPurl
 	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(httpStatus)
+	w.WriteHeader(http.StatusCreated)
 	err = json.NewEncoder(w).Encode(&responseBody)
 	if err != nil {
-		loggerWithField(r).Fatal(err.Error())
+		loggerWithField(r).Error(err.Error())
 	}
 	loggerWithField(r).Infof("User Created: %s", userName)
 
@@ -200,19 +227,23 @@ func UpdateUser(w http.ResponseWriter, r *http.Request) {
 		Operations []Operation `json:"operations"`
 	}{}
 	if err := json.NewDecoder(r.Body).Decode(&updateJob); err != nil {
-		loggerWithField(r).Fatal(err.Error())
+		loggerWithField(r).Error(err.Error())
+		handleScimError(w, r, invalidSyntaxError("%s", err.Error()))
+		return
 	}
-	for _, op := range updateJob.Operations {
-		if op.Op == "Replace" && op.Path == "active" {
-			result, err := EnableDisableUser(updateJob.UserId)
-			if err != nil && !result {
-				w.WriteHeader(http.StatusUnprocessableEntity)
-				loggerWithField(r).Error(err.Error())
-				return
-			}
-		}
+	user, err := findCurrentScimUser(r.Context(), updateJob.UserId)
+	if err != nil {
+		loggerWithField(r).Error(err.Error())
+		handleScimError(w, r, err)
+		return
 	}
-	w.WriteHeader(http.StatusOK)
+	user, err = patchSmcUser(r.Context(), user, updateJob.Operations)
+	if err != nil {
+		loggerWithField(r).Error(err.Error())
+		handleScimError(w, r, err)
+		return
+	}
+	writeScimUser(w, r, http.StatusOK, user)
 	loggerWithField(r).Infof("Updated User")
 	return
 }
@@ -220,26 +251,28 @@ func UpdateUser(w http.ResponseWriter, r *http.Request) {
 func DeleteUser(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	userName := vars["id"]
-	users, err := SmcUsers(userName)
+	users, err := SmcUsers(r.Context(), userName)
 	if err != nil {
 		loggerWithField(r).Error(err)
-		w.WriteHeader(http.StatusInternalServerError)
+		handleScimError(w, r, err)
 		return
 	}
 	if len(users) == 0 {
-		loggerWithField(r).Errorf("the given user id: %s not found", userName)
-		w.WriteHeader(http.StatusBadRequest)
+		err := notFoundError("the given user id: %s not found", userName)
+		loggerWithField(r).Error(err.Error())
+		handleScimError(w, r, err)
 		return
 	}
 	if len(users) > 1 {
-		loggerWithField(r).Errorf("multiple users with id: %s are exists", userName)
-		w.WriteHeader(http.StatusBadRequest)
+		err := uniquenessError("multiple users with id: %s are exists", userName)
+		loggerWithField(r).Error(err.Error())
+		handleScimError(w, r, err)
 		return
 	}
 	user := users[0]
-	if err := DeleteSmcUser(user["name"]); err != nil {
+	if err := DeleteSmcUser(r.Context(), user["name"]); err != nil {
 		loggerWithField(r).Error(err)
-		w.WriteHeader(http.StatusInternalServerError)
+		handleScimError(w, r, err)
 		return
 	}
 	w.WriteHeader(http.StatusNoContent)
@@ -0,0 +1,58 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/spf13/viper"
+	"strings"
+)
+
+// the identity provider the SMC admins are provisioned from. the deprovisioning and the roles sync depend on this
+// interface only. users are identified by the name of their SMC admin, the local part of their login
+type IdentitySource interface {
+	// the names of the users assigned to the connector app
+	AssignedUserNames() ([]string, error)
+	// check whether a user is known to the identity provider
+	UserExists(name string) (bool, error)
+	// the groups a user is member of, unknown users have no groups
+	UserGroups(name string) ([]IdentityGroup, error)
+}
+
+// a group of the identity source, the role mappings match either its id or its name
+type IdentityGroup struct {
+	Id   string
+	Name string
+}
+
+// create the identity source selected by IDENTITY_SOURCE in the config file
+func NewIdentitySourceFromConfig() (IdentitySource, error) {
+	switch source := strings.ToLower(viper.GetString("IDENTITY_SOURCE")); source {
+	case "azure":
+		client, err := NewGraphClientFromConfig()
+		if err != nil {
+			return nil, err
+		}
+		return client, nil
+	case "okta":
+		client, err := NewOktaClientFromConfig()
+		if err != nil {
+			return nil, err
+		}
+		return client, nil
+	case "ldap":
+		client, err := NewLdapSourceFromConfig()
+		if err != nil {
+			return nil, err
+		}
+		return client, nil
+	default:
+		return nil, fmt.Errorf("unsupported identity source %q, IDENTITY_SOURCE must be azure, okta or ldap", source)
+	}
+}
+
+// the SMC admin name of a login, logins in the form of an email are reduced to their local part
+func loginName(login string) string {
+	if i := strings.Index(login, "@"); i != -1 {
+		return login[:i]
+	}
+	return login
+}
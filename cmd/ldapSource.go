@@ -0,0 +1,297 @@
+package cmd
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// the matching rule of active directory resolving nested group memberships in the directory itself
+const ldapMatchingRuleInChain = "1.2.840.113556.1.4.1941"
+
+// the largest BER element read from the LDAP server, the default of asn1-ber lets a server make us allocate 2 GiB
+const ldapMaxPacketLength = 16 << 20
+
+func init() {
+	ber.MaxPacketLengthBytes = ldapMaxPacketLength
+}
+
+// the LDAP identity source, binding directly to an active directory or OpenLDAP server. the users assigned to the
+// connector are the members, also nested ones, of a group
+type LdapSource struct {
+	Url          string
+	BindDn       string
+	BindPassword string
+	BaseDn       string
+	// the group holding the users assigned to the connector
+	AssignedGroupDn string
+	// the attribute holding the SMC admin name of a user, sAMAccountName for active directory and uid for OpenLDAP
+	UserNameAttribute  string
+	GroupNameAttribute string
+	// resolve nested groups with the active directory matching rule instead of searching each level of groups
+	MatchingRuleInChain bool
+	// the number of entries read per page of a search, active directory refuses to return more than its MaxPageSize
+	// (1000 by default) entries to a search that is not paged
+	PageSize uint32
+	// upgrade ldap:// connections to TLS with StartTLS before binding
+	StartTls bool
+	// bind on a connection that is not encrypted, the bind password is sent in cleartext
+	AllowCleartextBind bool
+	TlsConfig          *tls.Config
+	Timeout            time.Duration
+}
+
+// create an LDAP identity source from the LDAP section of the config file
+func NewLdapSourceFromConfig() (*LdapSource, error) {
+	source := &LdapSource{
+		Url:                 viper.GetString("LDAP.URL"),
+		BindDn:              viper.GetString("LDAP.BIND_DN"),
+		BindPassword:        viper.GetString("LDAP.BIND_PASSWORD"),
+		BaseDn:              viper.GetString("LDAP.BASE_DN"),
+		AssignedGroupDn:     viper.GetString("LDAP.ASSIGNED_GROUP_DN"),
+		UserNameAttribute:   viper.GetString("LDAP.USER_NAME_ATTRIBUTE"),
+		GroupNameAttribute:  viper.GetString("LDAP.GROUP_NAME_ATTRIBUTE"),
+		MatchingRuleInChain: viper.GetBool("LDAP.MATCHING_RULE_IN_CHAIN"),
+		PageSize:            uint32(viper.GetInt("LDAP.PAGE_SIZE")),
+		StartTls:            viper.GetBool("LDAP.START_TLS"),
+		AllowCleartextBind:  viper.GetBool("LDAP.ALLOW_CLEARTEXT_BIND"),
+		TlsConfig:           &tls.Config{},
+		Timeout:             30 * time.Second,
+	}
+	if source.Url == "" || source.BaseDn == "" || source.AssignedGroupDn == "" {
+		return nil, errors.New("the fields LDAP.URL, LDAP.BASE_DN and LDAP.ASSIGNED_GROUP_DN in the config file are required")
+	}
+	ldapUrl, err := url.Parse(source.Url)
+	if err != nil {
+		return nil, err
+	}
+	if ldapUrl.Scheme != "ldap" && ldapUrl.Scheme != "ldaps" {
+		return nil, fmt.Errorf("unsupported LDAP.URL %s, the scheme must be ldap or ldaps", source.Url)
+	}
+	if ldapUrl.Scheme == "ldap" && !source.StartTls && source.BindDn != "" {
+		if !source.AllowCleartextBind {
+			return nil, errors.New("LDAP.URL is ldap:// without LDAP.START_TLS, the bind password would be sent in " +
+				"cleartext. use ldaps://, enable LDAP.START_TLS or set LDAP.ALLOW_CLEARTEXT_BIND")
+		}
+		logrus.Warn("LDAP.URL is ldap:// without LDAP.START_TLS, the bind password is sent in cleartext")
+	}
+	if caFile := viper.GetString("LDAP.CA_FILE"); caFile != "" {
+		buff, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(buff) {
+			return nil, fmt.Errorf("no certificate found in %s", caFile)
+		}
+		source.TlsConfig.RootCAs = pool
+	}
+	return source, nil
+}
+
+func (l *LdapSource) AssignedUserNames() ([]string, error) {
+	conn, err := l.connect()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	var users []*ldap.Entry
+	if l.MatchingRuleInChain {
+		users, err = l.search(conn, fmt.Sprintf("(&(%s=*)(memberOf:%s:=%s))", l.UserNameAttribute,
+			ldapMatchingRuleInChain, ldap.EscapeFilter(l.AssignedGroupDn)), []string{l.UserNameAttribute})
+	} else {
+		users, err = l.nestedMembers(conn)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, u := range users {
+		names = append(names, loginName(u.GetEqualFoldAttributeValue(l.UserNameAttribute)))
+	}
+	return names, nil
+}
+
+func (l *LdapSource) UserExists(name string) (bool, error) {
+	conn, err := l.connect()
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	user, err := l.findUser(conn, name)
+	return user != nil, err
+}
+
+// the groups of a user, the id of a group is its DN
+func (l *LdapSource) UserGroups(name string) ([]IdentityGroup, error) {
+	conn, err := l.connect()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	user, err := l.findUser(conn, name)
+	if err != nil || user == nil {
+		return nil, err
+	}
+	var groups []*ldap.Entry
+	if l.MatchingRuleInChain {
+		groups, err = l.search(conn, fmt.Sprintf("(member:%s:=%s)", ldapMatchingRuleInChain,
+			ldap.EscapeFilter(user.DN)), []string{l.GroupNameAttribute})
+	} else {
+		groups, err = l.nestedGroups(conn, user.DN)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var identityGroups []IdentityGroup
+	for _, g := range groups {
+		identityGroups = append(identityGroups, IdentityGroup{Id: g.DN,
+			Name: g.GetEqualFoldAttributeValue(l.GroupNameAttribute)})
+	}
+	return identityGroups, nil
+}
+
+// connect to the server and bind. the bind password is only sent on a TLS connection unless AllowCleartextBind is set
+func (l *LdapSource) connect() (*ldap.Conn, error) {
+	ldapUrl, err := url.Parse(l.Url)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{}
+	if l.TlsConfig != nil {
+		tlsConfig = l.TlsConfig.Clone()
+	}
+	if tlsConfig.ServerName == "" {
+		tlsConfig.ServerName = ldapUrl.Hostname()
+	}
+	conn, err := ldap.DialURL(l.Url, ldap.DialWithDialer(&net.Dialer{Timeout: l.Timeout}),
+		ldap.DialWithTLSConfig(tlsConfig))
+	if err != nil {
+		return nil, err
+	}
+	conn.SetTimeout(l.Timeout)
+	if ldapUrl.Scheme == "ldap" && l.StartTls {
+		if err := conn.StartTLS(tlsConfig); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if l.BindDn == "" {
+		return conn, nil
+	}
+	if _, ok := conn.TLSConnectionState(); !ok && !l.AllowCleartextBind {
+		conn.Close()
+		return nil, fmt.Errorf("refused to send the bind password in cleartext to %s", l.Url)
+	}
+	if err := conn.Bind(l.BindDn, l.BindPassword); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// search the subtree of the base DN, the entries are read in pages
+func (l *LdapSource) search(conn *ldap.Conn, filter string, attributes []string) ([]*ldap.Entry, error) {
+	request := ldap.NewSearchRequest(l.BaseDn, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false, filter,
+		attributes, nil)
+	result, err := conn.SearchWithPaging(request, l.PageSize)
+	if err != nil {
+		return nil, err
+	}
+	return result.Entries, nil
+}
+
+// read the attributes of an entry
+func (l *LdapSource) read(conn *ldap.Conn, dn string, attributes []string) ([]*ldap.Entry, error) {
+	request := ldap.NewSearchRequest(dn, ldap.ScopeBaseObject, ldap.NeverDerefAliases, 0, 0, false,
+		"(objectClass=*)", attributes, nil)
+	result, err := conn.Search(request)
+	if err != nil {
+		return nil, err
+	}
+	return result.Entries, nil
+}
+
+// find a user by its name, nil is returned for unknown users
+func (l *LdapSource) findUser(conn *ldap.Conn, name string) (*ldap.Entry, error) {
+	users, err := l.search(conn, fmt.Sprintf("(%s=%s)", l.UserNameAttribute, ldap.EscapeFilter(name)),
+		[]string{l.UserNameAttribute})
+	if err != nil {
+		return nil, err
+	}
+	for _, u := range users {
+		if strings.EqualFold(loginName(u.GetEqualFoldAttributeValue(l.UserNameAttribute)), name) {
+			return u, nil
+		}
+	}
+	return nil, nil
+}
+
+// the groups a DN is member of, directly or through other groups. each level of groups is searched by its members
+func (l *LdapSource) nestedGroups(conn *ldap.Conn, dn string) ([]*ldap.Entry, error) {
+	var groups []*ldap.Entry
+	visited := map[string]bool{strings.ToLower(dn): true}
+	for pending := []string{dn}; len(pending) != 0; {
+		member := ldap.EscapeFilter(pending[0])
+		pending = pending[1:]
+		parents, err := l.search(conn, fmt.Sprintf("(|(member=%s)(uniqueMember=%s))", member, member),
+			[]string{l.GroupNameAttribute})
+		if err != nil {
+			return nil, err
+		}
+		for _, g := range parents {
+			if visited[strings.ToLower(g.DN)] {
+				continue
+			}
+			visited[strings.ToLower(g.DN)] = true
+			groups = append(groups, g)
+			pending = append(pending, g.DN)
+		}
+	}
+	return groups, nil
+}
+
+// the users of the assigned group, also the members of its nested groups
+func (l *LdapSource) nestedMembers(conn *ldap.Conn) ([]*ldap.Entry, error) {
+	var users []*ldap.Entry
+	visited := map[string]bool{strings.ToLower(l.AssignedGroupDn): true}
+	for pending := []string{l.AssignedGroupDn}; len(pending) != 0; {
+		groups, err := l.read(conn, pending[0], []string{"member", "uniqueMember"})
+		pending = pending[1:]
+		if err != nil {
+			return nil, err
+		}
+		for _, g := range groups {
+			members := append(g.GetEqualFoldAttributeValues("member"), g.GetEqualFoldAttributeValues("uniqueMember")...)
+			for _, member := range members {
+				if visited[strings.ToLower(member)] {
+					continue
+				}
+				visited[strings.ToLower(member)] = true
+				entries, err := l.read(conn, member, []string{l.UserNameAttribute, "member", "uniqueMember"})
+				if err != nil {
+					return nil, err
+				}
+				for _, e := range entries {
+					if len(e.GetEqualFoldAttributeValues("member")) != 0 ||
+						len(e.GetEqualFoldAttributeValues("uniqueMember")) != 0 {
+						pending = append(pending, e.DN)
+					} else if e.GetEqualFoldAttributeValue(l.UserNameAttribute) != "" {
+						users = append(users, e)
+					}
+				}
+			}
+		}
+	}
+	return users, nil
+}
@@ -0,0 +1,479 @@
+package cmd
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+	"github.com/spf13/viper"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// an entry of the fake LDAP directory
+type fakeLdapEntry struct {
+	dn         string
+	attributes map[string][]string
+}
+
+// a bind received by the fake LDAP server
+type fakeLdapBind struct {
+	dn        string
+	encrypted bool
+}
+
+// an in-process LDAP server serving a fixed directory. it supports simple binds, StartTLS when a TLS config is given,
+// paged searches and the active directory matching rule resolving nested groups. like active directory, it refuses to
+// return more than maxResults entries to a search, the entries must then be read in pages
+type fakeLdap struct {
+	listener   net.Listener
+	entries    []*fakeLdapEntry
+	password   string
+	tlsConfig  *tls.Config
+	maxResults int
+
+	mu    sync.Mutex
+	binds []fakeLdapBind
+}
+
+// start a fake LDAP server, serving ldaps:// if ldaps is set
+func newFakeLdap(t *testing.T, tlsConfig *tls.Config, ldaps bool) *fakeLdap {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ldaps {
+		listener = tls.NewListener(listener, tlsConfig)
+	}
+	f := &fakeLdap{listener: listener, password: "secret", tlsConfig: tlsConfig, maxResults: 2}
+	f.add("dc=contoso,dc=com", nil)
+	f.add("ou=users,dc=contoso,dc=com", nil)
+	for _, name := range []string{"alice", "bob", "carol", "dave", "erin", "frank"} {
+		f.add(fmt.Sprintf("cn=%s,ou=users,dc=contoso,dc=com", name), map[string][]string{"sAMAccountName": {name}})
+	}
+	// operators is nested in smc users and smc users in operators
+	f.add("cn=SMC Users,dc=contoso,dc=com", map[string][]string{"cn": {"SMC Users"}, "member": {
+		"cn=alice,ou=users,dc=contoso,dc=com", "cn=bob,ou=users,dc=contoso,dc=com", "cn=Operators,dc=contoso,dc=com"}})
+	f.add("cn=Operators,dc=contoso,dc=com", map[string][]string{"cn": {"Operators"}, "member": {
+		"cn=carol,ou=users,dc=contoso,dc=com", "cn=dave,ou=users,dc=contoso,dc=com",
+		"cn=erin,ou=users,dc=contoso,dc=com", "cn=SMC Users,dc=contoso,dc=com"}})
+	f.add("cn=Editors,dc=contoso,dc=com", map[string][]string{"cn": {"Editors"}, "uniqueMember": {
+		"cn=alice,ou=users,dc=contoso,dc=com"}})
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+	return f
+}
+
+func (f *fakeLdap) Close() {
+	f.listener.Close()
+}
+
+func (f *fakeLdap) url(scheme string) string {
+	return scheme + "://" + f.listener.Addr().String()
+}
+
+func (f *fakeLdap) add(dn string, attributes map[string][]string) {
+	if attributes == nil {
+		attributes = make(map[string][]string)
+	}
+	f.entries = append(f.entries, &fakeLdapEntry{dn: dn, attributes: attributes})
+}
+
+func (f *fakeLdap) receivedBinds() []fakeLdapBind {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]fakeLdapBind(nil), f.binds...)
+}
+
+func (f *fakeLdap) serve(conn net.Conn) {
+	defer func() { conn.Close() }()
+	_, encrypted := conn.(*tls.Conn)
+	for {
+		request, err := ber.ReadPacket(conn)
+		if err != nil || len(request.Children) < 2 {
+			return
+		}
+		id := request.Children[0].Value.(int64)
+		op := request.Children[1]
+		switch op.Tag {
+		case ldap.ApplicationBindRequest:
+			dn := op.Children[1].Value.(string)
+			f.mu.Lock()
+			f.binds = append(f.binds, fakeLdapBind{dn: dn, encrypted: encrypted})
+			f.mu.Unlock()
+			code := ldap.LDAPResultSuccess
+			if op.Children[2].Data.String() != f.password {
+				code = ldap.LDAPResultInvalidCredentials
+			}
+			f.reply(conn, id, ldap.ApplicationBindResponse, code, nil)
+		case ldap.ApplicationUnbindRequest:
+			return
+		case ldap.ApplicationExtendedRequest:
+			if op.Children[0].Data.String() != "1.3.6.1.4.1.1466.20037" || f.tlsConfig == nil || encrypted {
+				f.reply(conn, id, ldap.ApplicationExtendedResponse, ldap.LDAPResultProtocolError, nil)
+				continue
+			}
+			f.reply(conn, id, ldap.ApplicationExtendedResponse, ldap.LDAPResultSuccess, nil)
+			tlsConn := tls.Server(conn, f.tlsConfig)
+			if err := tlsConn.Handshake(); err != nil {
+				return
+			}
+			conn, encrypted = tlsConn, true
+		case ldap.ApplicationSearchRequest:
+			var paging *ldap.ControlPaging
+			if len(request.Children) > 2 {
+				for _, child := range request.Children[2].Children {
+					if control, err := ldap.DecodeControl(child); err == nil {
+						paging, _ = control.(*ldap.ControlPaging)
+					}
+				}
+			}
+			f.search(conn, id, op, paging)
+		default:
+			f.reply(conn, id, ldap.ApplicationExtendedResponse, ldap.LDAPResultUnwillingToPerform, nil)
+		}
+	}
+}
+
+func (f *fakeLdap) search(conn net.Conn, id int64, op *ber.Packet, paging *ldap.ControlPaging) {
+	baseDn := op.Children[0].Value.(string)
+	scope := op.Children[1].Value.(int64)
+	filter := op.Children[6]
+	var attributes []string
+	for _, attribute := range op.Children[7].Children {
+		attributes = append(attributes, attribute.Value.(string))
+	}
+	base := f.entry(baseDn)
+	if base == nil {
+		f.reply(conn, id, ldap.ApplicationSearchResultDone, ldap.LDAPResultNoSuchObject, nil)
+		return
+	}
+	var found []*fakeLdapEntry
+	for _, e := range f.entries {
+		inScope := e == base || scope == ldap.ScopeWholeSubtree &&
+			strings.HasSuffix(strings.ToLower(e.dn), ","+strings.ToLower(base.dn))
+		if inScope && f.match(e, filter) {
+			found = append(found, e)
+		}
+	}
+	code := ldap.LDAPResultSuccess
+	var controls []ldap.Control
+	if paging != nil {
+		offset, _ := strconv.Atoi(string(paging.Cookie))
+		size := int(paging.PagingSize)
+		if size == 0 || size > f.maxResults {
+			size = f.maxResults
+		}
+		found = found[offset:]
+		response := ldap.NewControlPaging(0)
+		if len(found) > size {
+			found = found[:size]
+			response.SetCookie([]byte(strconv.Itoa(offset + size)))
+		}
+		controls = append(controls, response)
+	} else if len(found) > f.maxResults {
+		found = found[:f.maxResults]
+		code = ldap.LDAPResultSizeLimitExceeded
+	}
+	for _, e := range found {
+		entry := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultEntry, nil, "")
+		entry.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, e.dn, ""))
+		list := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+		for _, name := range attributes {
+			values := e.values(name)
+			if len(values) == 0 {
+				continue
+			}
+			attribute := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+			attribute.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, name, ""))
+			set := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "")
+			for _, value := range values {
+				set.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, value, ""))
+			}
+			attribute.AppendChild(set)
+			list.AppendChild(attribute)
+		}
+		entry.AppendChild(list)
+		f.write(conn, id, entry, nil)
+	}
+	f.reply(conn, id, ldap.ApplicationSearchResultDone, code, controls)
+}
+
+func (f *fakeLdap) reply(conn net.Conn, id int64, tag ber.Tag, code int, controls []ldap.Control) {
+	response := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "")
+	response.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, int64(code), ""))
+	response.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""))
+	response.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""))
+	f.write(conn, id, response, controls)
+}
+
+func (f *fakeLdap) write(conn net.Conn, id int64, op *ber.Packet, controls []ldap.Control) {
+	message := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+	message.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, id, ""))
+	message.AppendChild(op)
+	if len(controls) != 0 {
+		list := ber.Encode(ber.ClassContext, ber.TypeConstructed, 0, nil, "")
+		for _, control := range controls {
+			list.AppendChild(control.Encode())
+		}
+		message.AppendChild(list)
+	}
+	conn.Write(message.Bytes())
+}
+
+func (f *fakeLdap) entry(dn string) *fakeLdapEntry {
+	for _, e := range f.entries {
+		if strings.EqualFold(e.dn, dn) {
+			return e
+		}
+	}
+	return nil
+}
+
+func (e *fakeLdapEntry) values(attribute string) []string {
+	for name, values := range e.attributes {
+		if strings.EqualFold(name, attribute) {
+			return values
+		}
+	}
+	return nil
+}
+
+func (e *fakeLdapEntry) hasValue(attribute string, value string) bool {
+	for _, v := range e.values(attribute) {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// check whether the group holds the DN, directly or through nested groups
+func (f *fakeLdap) nestedMember(group *fakeLdapEntry, dn string, visited map[*fakeLdapEntry]bool) bool {
+	if group == nil || visited[group] {
+		return false
+	}
+	visited[group] = true
+	for _, member := range append(group.values("member"), group.values("uniqueMember")...) {
+		if strings.EqualFold(member, dn) || f.nestedMember(f.entry(member), dn, visited) {
+			return true
+		}
+	}
+	return false
+}
+
+// evaluate the filters used by the LDAP source: and, or, equality, presence and the nested groups matching rule
+func (f *fakeLdap) match(e *fakeLdapEntry, filter *ber.Packet) bool {
+	switch filter.Tag {
+	case ldap.FilterAnd:
+		for _, child := range filter.Children {
+			if !f.match(e, child) {
+				return false
+			}
+		}
+		return true
+	case ldap.FilterOr:
+		for _, child := range filter.Children {
+			if f.match(e, child) {
+				return true
+			}
+		}
+		return false
+	case ldap.FilterEqualityMatch:
+		return e.hasValue(filter.Children[0].Value.(string), filter.Children[1].Value.(string))
+	case ldap.FilterPresent:
+		attribute := filter.Data.String()
+		return strings.EqualFold(attribute, "objectClass") || len(e.values(attribute)) != 0
+	case ldap.FilterExtensibleMatch:
+		parts := make(map[ber.Tag]string)
+		for _, child := range filter.Children {
+			parts[child.Tag] = child.Data.String()
+		}
+		if parts[1] != ldapMatchingRuleInChain {
+			return false
+		}
+		switch strings.ToLower(parts[2]) {
+		case "memberof":
+			return f.nestedMember(f.entry(parts[3]), e.dn, make(map[*fakeLdapEntry]bool))
+		case "member":
+			return f.nestedMember(e, parts[3], make(map[*fakeLdapEntry]bool))
+		}
+	}
+	return false
+}
+
+// a source reading the fake directory, the page size is below the limit of the server
+func newTestLdapSource(f *fakeLdap, scheme string, ca *testCertificate) *LdapSource {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.certificate)
+	return &LdapSource{
+		Url:                f.url(scheme),
+		BindDn:             "cn=connector,dc=contoso,dc=com",
+		BindPassword:       "secret",
+		BaseDn:             "dc=contoso,dc=com",
+		AssignedGroupDn:    "cn=SMC Users,dc=contoso,dc=com",
+		UserNameAttribute:  "sAMAccountName",
+		GroupNameAttribute: "cn",
+		PageSize:           1,
+		StartTls:           true,
+		TlsConfig:          &tls.Config{RootCAs: pool},
+		Timeout:            5 * time.Second,
+	}
+}
+
+func testLdapServerTls(t *testing.T) (*testCertificate, *tls.Config) {
+	ca := issueTestCertificate(t, nil, "LDAP test CA", 0)
+	serverCert := issueTestCertificate(t, ca, "ldap", x509.ExtKeyUsageServerAuth)
+	return ca, &tls.Config{Certificates: []tls.Certificate{serverCert.tlsCertificate(t)}}
+}
+
+func TestLdapSource(t *testing.T) {
+	ca, tlsConfig := testLdapServerTls(t)
+	f := newFakeLdap(t, tlsConfig, true)
+	defer f.Close()
+	for _, matchingRuleInChain := range []bool{true, false} {
+		source := newTestLdapSource(f, "ldaps", ca)
+		source.MatchingRuleInChain = matchingRuleInChain
+
+		names, err := source.AssignedUserNames()
+		if err != nil {
+			t.Fatalf("matching rule %t: %s", matchingRuleInChain, err)
+		}
+		sort.Strings(names)
+		if got := strings.Join(names, ","); got != "alice,bob,carol,dave,erin" {
+			t.Errorf("matching rule %t: got the assigned users %s, want alice,bob,carol,dave,erin",
+				matchingRuleInChain, got)
+		}
+		for name, want := range map[string]bool{"alice": true, "FRANK": true, "zoe": false, "*": false} {
+			if exists, err := source.UserExists(name); err != nil || exists != want {
+				t.Errorf("matching rule %t: got %t, %v for the user %s, want %t", matchingRuleInChain, exists, err,
+					name, want)
+			}
+		}
+		for name, want := range map[string]string{
+			"alice": "Editors,Operators,SMC Users",
+			"carol": "Operators,SMC Users",
+			"frank": "",
+		} {
+			groups, err := source.UserGroups(name)
+			if err != nil {
+				t.Fatalf("matching rule %t: %s", matchingRuleInChain, err)
+			}
+			var groupNames []string
+			for _, group := range groups {
+				groupNames = append(groupNames, group.Name)
+			}
+			sort.Strings(groupNames)
+			if got := strings.Join(groupNames, ","); got != want {
+				t.Errorf("matching rule %t: got the groups %s of %s, want %s", matchingRuleInChain, got, name, want)
+			}
+		}
+	}
+}
+
+func TestLdapSourceSearchesInPages(t *testing.T) {
+	ca, tlsConfig := testLdapServerTls(t)
+	f := newFakeLdap(t, tlsConfig, true)
+	defer f.Close()
+	source := newTestLdapSource(f, "ldaps", ca)
+	source.MatchingRuleInChain = true
+
+	// the server limit applies to searches that are not paged
+	conn, err := source.connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = conn.Search(ldap.NewSearchRequest(source.BaseDn, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0,
+		false, "(sAMAccountName=*)", nil, nil))
+	conn.Close()
+	if !ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded) {
+		t.Errorf("got %v without paging, want sizeLimitExceeded", err)
+	}
+	for _, pageSize := range []uint32{1, 2, 500} {
+		source.PageSize = pageSize
+		if names, err := source.AssignedUserNames(); err != nil || len(names) != 5 {
+			t.Errorf("page size %d: got %v, %v, want the 5 assigned users", pageSize, names, err)
+		}
+	}
+}
+
+func TestLdapSourceStartTls(t *testing.T) {
+	ca, tlsConfig := testLdapServerTls(t)
+	f := newFakeLdap(t, tlsConfig, false)
+	defer f.Close()
+	source := newTestLdapSource(f, "ldap", ca)
+
+	if exists, err := source.UserExists("alice"); err != nil || !exists {
+		t.Fatalf("got %t, %v for the user alice, want true", exists, err)
+	}
+	for _, bind := range f.receivedBinds() {
+		if !bind.encrypted {
+			t.Error("the bind has been sent before StartTLS")
+		}
+	}
+	// the certificate of the server must be trusted
+	source.TlsConfig = &tls.Config{RootCAs: x509.NewCertPool()}
+	if _, err := source.UserExists("alice"); err == nil {
+		t.Error("StartTLS succeeded with a server certificate that is not trusted")
+	}
+}
+
+func TestLdapSourceRefusesCleartextBind(t *testing.T) {
+	ca, _ := testLdapServerTls(t)
+	// a server without TLS
+	f := newFakeLdap(t, nil, false)
+	defer f.Close()
+	source := newTestLdapSource(f, "ldap", ca)
+
+	if _, err := source.UserExists("alice"); err == nil {
+		t.Error("StartTLS succeeded on a server without TLS")
+	}
+	source.StartTls = false
+	if _, err := source.UserExists("alice"); err == nil {
+		t.Error("the bind password has been sent in cleartext")
+	}
+	if binds := f.receivedBinds(); len(binds) != 0 {
+		t.Errorf("got the binds %v without TLS", binds)
+	}
+	source.AllowCleartextBind = true
+	if exists, err := source.UserExists("alice"); err != nil || !exists {
+		t.Errorf("got %t, %v for the user alice with cleartext binds allowed, want true", exists, err)
+	}
+
+	viper.Reset()
+	setConfigDefaults()
+	viper.Set("LDAP.URL", f.url("ldap"))
+	viper.Set("LDAP.BASE_DN", "dc=contoso,dc=com")
+	viper.Set("LDAP.ASSIGNED_GROUP_DN", "cn=SMC Users,dc=contoso,dc=com")
+	viper.Set("LDAP.BIND_DN", "cn=connector,dc=contoso,dc=com")
+	viper.Set("LDAP.START_TLS", false)
+	if _, err := NewLdapSourceFromConfig(); err == nil {
+		t.Error("an ldap:// URL without StartTLS has been accepted")
+	}
+	viper.Set("LDAP.ALLOW_CLEARTEXT_BIND", true)
+	if _, err := NewLdapSourceFromConfig(); err != nil {
+		t.Errorf("got %v with cleartext binds allowed", err)
+	}
+}
+
+func TestLdapRefusesOversizedElements(t *testing.T) {
+	// an octet string claiming a length of 2 GiB
+	header := []byte{0x04, 0x84, 0x7f, 0xff, 0xff, 0xff}
+	if _, err := ber.ReadPacket(strings.NewReader(string(header))); err == nil ||
+		!strings.Contains(err.Error(), "greater than maximum") {
+		t.Errorf("got %v, want the length refused", err)
+	}
+}
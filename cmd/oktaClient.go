@@ -0,0 +1,155 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/spf13/viper"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// the okta identity source, a client of the okta management API authenticated with an API token. users are
+// identified by the local part of their okta login
+type OktaClient struct {
+	OrgUrl   string
+	ApiToken string
+	// the id of the okta application the users are assigned to
+	AppId      string
+	HttpClient *http.Client
+}
+
+type oktaUser struct {
+	Id      string `json:"id"`
+	Profile struct {
+		Login string `json:"login"`
+	} `json:"profile"`
+}
+
+// create an okta client from the OKTA section of the config file
+func NewOktaClientFromConfig() (*OktaClient, error) {
+	client := &OktaClient{
+		OrgUrl:     strings.TrimSuffix(viper.GetString("OKTA.ORG_URL"), "/"),
+		ApiToken:   viper.GetString("OKTA.API_TOKEN"),
+		AppId:      viper.GetString("OKTA.APP_ID"),
+		HttpClient: &http.Client{Timeout: 30 * time.Second},
+	}
+	if client.OrgUrl == "" || client.ApiToken == "" || client.AppId == "" {
+		return nil, errors.New("the fields OKTA.ORG_URL, OKTA.API_TOKEN and OKTA.APP_ID in the config file are required")
+	}
+	return client, nil
+}
+
+func (o *OktaClient) AssignedUserNames() ([]string, error) {
+	var names []string
+	err := o.getAll(fmt.Sprintf("/api/v1/apps/%s/users?limit=200", url.PathEscape(o.AppId)), func(page []byte) error {
+		var appUsers []struct {
+			Credentials struct {
+				UserName string `json:"userName"`
+			} `json:"credentials"`
+		}
+		if err := json.Unmarshal(page, &appUsers); err != nil {
+			return err
+		}
+		for _, u := range appUsers {
+			names = append(names, loginName(u.Credentials.UserName))
+		}
+		return nil
+	})
+	return names, err
+}
+
+func (o *OktaClient) UserExists(name string) (bool, error) {
+	user, err := o.findUser(name)
+	return user != nil, err
+}
+
+func (o *OktaClient) UserGroups(name string) ([]IdentityGroup, error) {
+	user, err := o.findUser(name)
+	if err != nil || user == nil {
+		return nil, err
+	}
+	var groups []IdentityGroup
+	err = o.getAll(fmt.Sprintf("/api/v1/users/%s/groups", url.PathEscape(user.Id)), func(page []byte) error {
+		var oktaGroups []struct {
+			Id      string `json:"id"`
+			Profile struct {
+				Name string `json:"name"`
+			} `json:"profile"`
+		}
+		if err := json.Unmarshal(page, &oktaGroups); err != nil {
+			return err
+		}
+		for _, g := range oktaGroups {
+			groups = append(groups, IdentityGroup{Id: g.Id, Name: g.Profile.Name})
+		}
+		return nil
+	})
+	return groups, err
+}
+
+// find a user by the local part of its login, nil is returned for unknown users
+func (o *OktaClient) findUser(name string) (*oktaUser, error) {
+	query := url.Values{}
+	query.Set("search", fmt.Sprintf("profile.login sw \"%s@\"", strings.ReplaceAll(name, "\"", "\\\"")))
+	var found *oktaUser
+	err := o.getAll("/api/v1/users?"+query.Encode(), func(page []byte) error {
+		var users []oktaUser
+		if err := json.Unmarshal(page, &users); err != nil {
+			return err
+		}
+		for i, u := range users {
+			if found == nil && strings.EqualFold(loginName(u.Profile.Login), name) {
+				found = &users[i]
+			}
+		}
+		return nil
+	})
+	return found, err
+}
+
+// read all pages of an okta collection, the next page is given in the Link header of each page
+func (o *OktaClient) getAll(path string, readPage func(page []byte) error) error {
+	for next := o.OrgUrl + path; next != ""; {
+		request, err := http.NewRequest("GET", next, nil)
+		if err != nil {
+			return err
+		}
+		request.Header.Set("Authorization", "SSWS "+o.ApiToken)
+		request.Header.Set("Accept", "application/json")
+		response, err := o.HttpClient.Do(request)
+		if err != nil {
+			return err
+		}
+		buff, err := ioutil.ReadAll(response.Body)
+		response.Body.Close()
+		if err != nil {
+			return err
+		}
+		if response.StatusCode != http.StatusOK {
+			return fmt.Errorf("unexpected http status %d received from okta: %s", response.StatusCode, string(buff))
+		}
+		if err := readPage(buff); err != nil {
+			return err
+		}
+		next = nextLink(response.Header["Link"])
+	}
+	return nil
+}
+
+// find the link to the next page in Link headers such as: <https://org.okta.com/api/v1/users?after=x>; rel="next"
+func nextLink(links []string) string {
+	for _, header := range links {
+		for _, link := range strings.Split(header, ",") {
+			parts := strings.Split(link, ";")
+			if len(parts) < 2 || !strings.Contains(strings.Join(parts[1:], ";"), `rel="next"`) {
+				continue
+			}
+			return strings.Trim(strings.TrimSpace(parts[0]), "<>")
+		}
+	}
+	return ""
+}
@@ -0,0 +1,130 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// a fake okta org with the users alice, bob and carol assigned to the app app1, given one user per page
+func newFakeOkta(t *testing.T) *httptest.Server {
+	logins := map[string]string{"u1": "alice@contoso.com", "u2": "bob@contoso.com", "u3": "carol@contoso.com",
+		"u4": "alice.smith@contoso.com"}
+	groups := map[string][]map[string]interface{}{
+		"u1": {
+			{"id": "00g1", "profile": map[string]string{"name": "Everyone"}},
+			{"id": "00g2", "profile": map[string]string{"name": "SMC Editors"}},
+		},
+	}
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "SSWS token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		var body interface{}
+		switch {
+		case r.URL.Path == "/api/v1/apps/app1/users":
+			ids := []string{"u1", "u2", "u3"}
+			var page int
+			fmt.Sscan(r.URL.Query().Get("after"), &page)
+			w.Header().Add("Link", fmt.Sprintf(`<%s%s>; rel="self"`, server.URL, r.URL.RequestURI()))
+			if page+1 < len(ids) {
+				w.Header().Add("Link", fmt.Sprintf(`<%s/api/v1/apps/app1/users?after=%d&limit=1>; rel="next"`,
+					server.URL, page+1))
+			}
+			body = []map[string]interface{}{{"id": ids[page], "credentials": map[string]string{
+				"userName": logins[ids[page]]}}}
+		case r.URL.Path == "/api/v1/users":
+			var prefix string
+			if _, err := fmt.Sscanf(r.URL.Query().Get("search"), "profile.login sw %q", &prefix); err != nil {
+				t.Errorf("unexpected search %q", r.URL.Query().Get("search"))
+			}
+			users := []map[string]interface{}{}
+			for id, login := range logins {
+				// sw ignores the case
+				if strings.HasPrefix(login, strings.ToLower(prefix)) {
+					users = append(users, map[string]interface{}{"id": id, "profile": map[string]string{"login": login}})
+				}
+			}
+			body = users
+		case strings.HasPrefix(r.URL.Path, "/api/v1/users/") && strings.HasSuffix(r.URL.Path, "/groups"):
+			id := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/api/v1/users/"), "/groups")
+			userGroups := groups[id]
+			if userGroups == nil {
+				userGroups = []map[string]interface{}{}
+			}
+			body = userGroups
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(body)
+	}))
+	return server
+}
+
+func TestOktaClient(t *testing.T) {
+	server := newFakeOkta(t)
+	defer server.Close()
+	client := &OktaClient{OrgUrl: server.URL, ApiToken: "token", AppId: "app1", HttpClient: server.Client()}
+
+	names, err := client.AssignedUserNames()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(names, ","); got != "alice,bob,carol" {
+		t.Errorf("got the assigned users %s, want alice,bob,carol", got)
+	}
+	for name, want := range map[string]bool{"alice": true, "Bob": true, "alice.smith": true, "al": false,
+		"erin": false} {
+		if exists, err := client.UserExists(name); err != nil || exists != want {
+			t.Errorf("got %t, %v for the user %s, want %t", exists, err, name, want)
+		}
+	}
+	groups, err := client.UserGroups("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var groupNames []string
+	for _, group := range groups {
+		groupNames = append(groupNames, group.Id+" "+group.Name)
+	}
+	sort.Strings(groupNames)
+	if got := strings.Join(groupNames, ","); got != "00g1 Everyone,00g2 SMC Editors" {
+		t.Errorf("got the groups %s of alice", got)
+	}
+	if groups, err := client.UserGroups("erin"); err != nil || len(groups) != 0 {
+		t.Errorf("got %v, %v for the groups of an unknown user", groups, err)
+	}
+
+	client.ApiToken = "revoked"
+	if _, err := client.AssignedUserNames(); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("got %v with a revoked token, want the status 401", err)
+	}
+}
+
+func TestOktaNextLink(t *testing.T) {
+	tests := []struct {
+		links []string
+		want  string
+	}{
+		{nil, ""},
+		{[]string{`<https://org.okta.com/api/v1/users?limit=2>; rel="self"`}, ""},
+		{[]string{`<https://org.okta.com/api/v1/users?limit=2>; rel="self"`,
+			`<https://org.okta.com/api/v1/users?after=b&limit=2>; rel="next"`},
+			"https://org.okta.com/api/v1/users?after=b&limit=2"},
+		{[]string{`<https://org.okta.com/api/v1/users?limit=2>; rel="self", ` +
+			`<https://org.okta.com/api/v1/users?after=b>; rel="next"`}, "https://org.okta.com/api/v1/users?after=b"},
+	}
+	for _, test := range tests {
+		if got := nextLink(test.links); got != test.want {
+			t.Errorf("got %q for %v, want %q", got, test.links, test.want)
+		}
+	}
+}
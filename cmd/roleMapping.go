@@ -0,0 +1,137 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"github.cicd.cloud.fpdev.io/BD/scim-smc-connector/lib"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"strings"
+	"time"
+)
+
+// the SMC roles applied on the members of a group of the identity source. the group is given by its name or its id.
+// the roles are granted in the admin domains and on the access control lists given by their name, the shared domain
+// and all elements when none are given
+type RoleMapping struct {
+	Group           string   `mapstructure:"GROUP"`
+	Roles           []string `mapstructure:"ROLES"`
+	Domains         []string `mapstructure:"DOMAINS"`
+	GrantedElements []string `mapstructure:"GRANTED_ELEMENTS"`
+}
+
+// a role granted to a user by a role mapping
+type RoleGrant struct {
+	Role            string
+	Domains         []string
+	GrantedElements []string
+}
+
+// the SMC roles which are applied on the members of the groups with the same name when no ROLE_MAPPING is configured
+var roleGroupNames = []string{"Editor", "Operator", "Owner", "Viewer", "Superuser", "NSX Role", "Logs Viewer",
+	"Reports Manager", "Monitor"}
+
+// load the ROLE_MAPPING section of the config file
+func LoadRoleMappings() ([]RoleMapping, error) {
+	var mappings []RoleMapping
+	if err := viper.UnmarshalKey("ROLE_MAPPING", &mappings); err != nil {
+		return nil, fmt.Errorf("failed in reading ROLE_MAPPING in the config file: %s", err)
+	}
+	if len(mappings) == 0 {
+		for _, role := range roleGroupNames {
+			mappings = append(mappings, RoleMapping{Group: role, Roles: []string{role}})
+		}
+		return mappings, nil
+	}
+	for i, mapping := range mappings {
+		if strings.TrimSpace(mapping.Group) == "" || len(mapping.Roles) == 0 {
+			return nil, fmt.Errorf("the entry %d of ROLE_MAPPING in the config file requires a GROUP and at least one role in ROLES", i+1)
+		}
+	}
+	return mappings, nil
+}
+
+// connect to SMC and check the role mappings against its roles, admin domains and access control lists. SMC is tried
+// again while it cannot be reached, until SMC.STARTUP_TIMEOUT_IN_SECONDS, so the connector can start along with SMC
+func ValidateRoleMappingsOnSmc(mappings []RoleMapping) error {
+	timeout := time.Duration(viper.GetInt("SMC.STARTUP_TIMEOUT_IN_SECONDS")) * time.Second
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	retry := newSmcRetryPolicyFromConfig()
+	for attempt := 0; ; attempt++ {
+		err := smcSession.Open(ctx)
+		var elements *PermissionElements
+		if err == nil {
+			elements, err = GetPermissionElements(ctx)
+		}
+		if err == nil {
+			return ValidateRoleMappings(mappings, elements)
+		}
+		delay := retry.delay(attempt)
+		logrus.Warnf("failed in loading the SMC roles, retrying in %s: %s", delay, err)
+		if lib.SleepContext(ctx, delay) != nil {
+			return fmt.Errorf("failed in loading the SMC roles for %s, the role mappings are not validated: %s",
+				timeout, err)
+		}
+	}
+}
+
+// check that all roles, admin domains and access control lists of the config file exist on SMC. the default role
+// mappings only warn about their roles missing on SMC, not every SMC has all of them
+func ValidateRoleMappings(mappings []RoleMapping, elements *PermissionElements) error {
+	var unknown []string
+	check := func(kind string, names []string, hrefs map[string]string) {
+		for _, name := range names {
+			if _, ok := hrefs[name]; !ok && !lib.StringInSlice(kind+" "+name, unknown) {
+				unknown = append(unknown, kind+" "+name)
+			}
+		}
+	}
+	defaults := !isRoleMappingConfigured()
+	for _, mapping := range mappings {
+		if defaults {
+			for _, role := range mapping.Roles {
+				if _, ok := elements.Roles[role]; !ok {
+					logrus.Warnf("the role %s does not exist on SMC, the members of the group %s get no role", role,
+						mapping.Group)
+				}
+			}
+			continue
+		}
+		check("role", mapping.Roles, elements.Roles)
+		check("admin domain", mapping.Domains, elements.Domains)
+		check("access control list", mapping.GrantedElements, elements.GrantedElements)
+	}
+	check("admin domain", viper.GetStringSlice("ROLES.DOMAINS"), elements.Domains)
+	check("access control list", viper.GetStringSlice("ROLES.GRANTED_ELEMENTS"), elements.GrantedElements)
+	check("admin domain", []string{viper.GetString("SMC.DEFAULT_DOMAIN")}, elements.Domains)
+	check("access control list", []string{viper.GetString("SMC.DEFAULT_GRANTED_ELEMENTS")}, elements.GrantedElements)
+	if len(unknown) != 0 {
+		return fmt.Errorf("the %s of the config file do not exist on SMC", strings.Join(unknown, ", "))
+	}
+	return nil
+}
+
+// whether the config file has a ROLE_MAPPING, the default mappings are used otherwise
+func isRoleMappingConfigured() bool {
+	mappings, _ := viper.Get("ROLE_MAPPING").([]interface{})
+	return len(mappings) != 0
+}
+
+// the roles granted by the mappings of the given groups, in the order of the mappings
+func mappedRoles(mappings []RoleMapping, groups []IdentityGroup) []RoleGrant {
+	var grants []RoleGrant
+	for _, mapping := range mappings {
+		for _, group := range groups {
+			if !strings.EqualFold(mapping.Group, group.Name) && !strings.EqualFold(mapping.Group, group.Id) {
+				continue
+			}
+			for _, role := range mapping.Roles {
+				grants = append(grants, RoleGrant{Role: role, Domains: mapping.Domains,
+					GrantedElements: mapping.GrantedElements})
+			}
+			break
+		}
+	}
+	return grants
+}
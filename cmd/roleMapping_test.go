@@ -0,0 +1,104 @@
+package cmd
+
+import (
+	"github.com/spf13/viper"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidateRoleMappings(t *testing.T) {
+	elements := &PermissionElements{
+		Roles:           map[string]string{"Editor": "role/1", "Viewer": "role/2"},
+		Domains:         map[string]string{"Shared Domain": "admin_domain/1"},
+		GrantedElements: map[string]string{"ALL Elements": "access_control_list/1"},
+	}
+	tests := []struct {
+		name        string
+		roleMapping []interface{}
+		valid       bool
+	}{
+		{"defaults", nil, true},
+		{"configured", []interface{}{
+			map[string]interface{}{"GROUP": "Editors", "ROLES": []interface{}{"Editor"}},
+		}, true},
+		{"configured missing role", []interface{}{
+			map[string]interface{}{"GROUP": "NSX Admins", "ROLES": []interface{}{"NSX Role"}},
+		}, false},
+		{"configured missing domain", []interface{}{
+			map[string]interface{}{"GROUP": "Editors", "ROLES": []interface{}{"Editor"},
+				"DOMAINS": []interface{}{"Branch Domain"}},
+		}, false},
+	}
+	for _, test := range tests {
+		viper.Reset()
+		setConfigDefaults()
+		if test.roleMapping != nil {
+			viper.Set("ROLE_MAPPING", test.roleMapping)
+		}
+		mappings, err := LoadRoleMappings()
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		if err := ValidateRoleMappings(mappings, elements); (err == nil) != test.valid {
+			t.Errorf("%s: got error %v, want valid=%t", test.name, err, test.valid)
+		}
+	}
+}
+
+func TestValidateRoleMappingsOnSmc(t *testing.T) {
+	f := newFakeSmc(t)
+	defer f.Close()
+	viper.Set("SMC.RETRY_ATTEMPTS", 0)
+	viper.Set("SMC.CIRCUIT_BREAKER_FAILURES", 0)
+	if err := InstallSmcClient(); err != nil {
+		t.Fatal(err)
+	}
+	mappings, err := LoadRoleMappings()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// SMC fails the first loads of its roles while it starts
+	failures := 3
+	f.setFailure(func(r *http.Request) int {
+		if strings.HasSuffix(r.URL.Path, "/elements/role") && failures > 0 {
+			failures--
+			return http.StatusServiceUnavailable
+		}
+		return 0
+	})
+	if err := ValidateRoleMappingsOnSmc(mappings); err != nil {
+		t.Fatal(err)
+	}
+	if loads := f.count(http.MethodGet, "/elements/role"); loads != 4 {
+		t.Errorf("got %d loads of the roles, want 4", loads)
+	}
+
+	viper.Set("ROLE_MAPPING", []interface{}{
+		map[string]interface{}{"GROUP": "NSX Admins", "ROLES": []interface{}{"NSX Role"}},
+	})
+	if mappings, err = LoadRoleMappings(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ValidateRoleMappingsOnSmc(mappings); err == nil {
+		t.Error("got no error for a role missing on SMC")
+	}
+
+	f.Close()
+	smcElements = newSmcElementCache()
+	viper.Set("ROLE_MAPPING", nil)
+	viper.Set("SMC.STARTUP_TIMEOUT_IN_SECONDS", 1)
+	viper.Set("SMC.RETRY_BASE_DELAY_IN_MILLISECONDS", 100)
+	viper.Set("SMC.RETRY_MAX_DELAY_IN_SECONDS", 1)
+	if mappings, err = LoadRoleMappings(); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if err := ValidateRoleMappingsOnSmc(mappings); err == nil {
+		t.Error("got no error while SMC is down")
+	}
+	if elapsed := time.Since(start); elapsed < time.Second || elapsed > 5*time.Second {
+		t.Errorf("gave up after %s, want about 1s", elapsed)
+	}
+}
@@ -14,8 +14,7 @@ import (
 )
 
 var (
-	cfgFile     string
-	SmcInstance smc.Smc
+	cfgFile string
 )
 
 // rootCmd represents the base command when called without any subcommands
@@ -42,32 +41,7 @@ func init() {
 
 // initConfig reads in config file and ENV variables if set.
 func initConfig() {
-	//set the default values
-	viper.SetDefault("issuer", "ForcePoint")
-	viper.SetDefault("ROLES_UPDATE_TIME_IN_MINUTES", 3)
-	viper.SetDefault("ROLES.PERMISSIONS.VIEWER", true)
-	viper.SetDefault("ROLES.PERMISSIONS.LOGS_VIEWER", false)
-	viper.SetDefault("ROLES.PERMISSIONS.REPORTS_MANAGER", false)
-	viper.SetDefault("ROLES.PERMISSIONS.OWNER", false)
-	viper.SetDefault("ROLES.PERMISSIONS.OPERATOR", false)
-	viper.SetDefault("ROLES.PERMISSIONS.MONITOR", false)
-	viper.SetDefault("ROLES.PERMISSIONS.EDITOR", false)
-	viper.SetDefault("ROLES.PERMISSIONS.NSX_ROLE", false)
-	viper.SetDefault("ROLES.PERMISSIONS.SUPPERUSER", false)
-	viper.SetDefault("ROLES.CAN_USE_API", false)
-	viper.SetDefault("ROLES.ALLOW_SUDO", false)
-	viper.SetDefault("ROLES.CONSOLE_SUPPER_USER", false)
-	viper.SetDefault("ROLES.ALLOW_TO_LOGS_IN_SHARED", true)
-	viper.SetDefault("LOG_FORMAT_JSON", false)
-	viper.SetDefault("CONNECTOR.HOSTNAME", "localhost")
-	viper.SetDefault("CONNECTOR.PORT", 8085)
-	viper.SetDefault("SMC.API_VERSION", "6.7")
-	viper.SetDefault("SMC.PORT", "8082")
-	viper.SetDefault("SMC.NAME", "smc")
-	viper.SetDefault("AZURE_ADMIN_LOGIN_NAME", "")
-	viper.SetDefault("APP_NAME", "")
-	viper.SetDefault("AZURE_ADMIN_LOGIN_PASSWORD", "")
-
+	setConfigDefaults()
 	viper.AutomaticEnv() // read in environment variables that match
 	if cfgFile != "" {
 		if !lib.FileExists(cfgFile) {
@@ -104,11 +78,66 @@ func initConfig() {
 	}
 	logrus.SetOutput(os.Stdout)
 
-	SmcInstance = smc.Smc{
+	smcSession = NewSmcSession(&smc.Smc{
 		Hostname:   viper.GetString("SMC.IP_ADDRESS"),
 		Port:       viper.GetString("SMC.PORT"),
 		AccessKey:  viper.GetString("SMC.KEY"),
-		APIVersion: viper.GetString("SMC.API_VERSION"),
+		APIVersion: configuredSmcApiVersion(),
+	})
+	if err := InstallSmcClient(); err != nil {
+		log.Fatal(err.Error())
 	}
 
 }
+
+// set the default values of the config
+func setConfigDefaults() {
+	viper.SetDefault("issuer", "ForcePoint")
+	viper.SetDefault("ROLES_UPDATE_TIME_IN_MINUTES", 3)
+	viper.SetDefault("ROLES.PERMISSIONS.VIEWER", true)
+	viper.SetDefault("ROLES.PERMISSIONS.LOGS_VIEWER", false)
+	viper.SetDefault("ROLES.PERMISSIONS.REPORTS_MANAGER", false)
+	viper.SetDefault("ROLES.PERMISSIONS.OWNER", false)
+	viper.SetDefault("ROLES.PERMISSIONS.OPERATOR", false)
+	viper.SetDefault("ROLES.PERMISSIONS.MONITOR", false)
+	viper.SetDefault("ROLES.PERMISSIONS.EDITOR", false)
+	viper.SetDefault("ROLES.PERMISSIONS.NSX_ROLE", false)
+	viper.SetDefault("ROLES.PERMISSIONS.SUPPERUSER", false)
+	viper.SetDefault("ROLES.CAN_USE_API", false)
+	viper.SetDefault("ROLES.ALLOW_SUDO", false)
+	viper.SetDefault("ROLES.CONSOLE_SUPPER_USER", false)
+	viper.SetDefault("ROLES.ALLOW_TO_LOGS_IN_SHARED", true)
+	viper.SetDefault("LOG_FORMAT_JSON", false)
+	viper.SetDefault("CONNECTOR.HOSTNAME", "localhost")
+	viper.SetDefault("CONNECTOR.PORT", 8085)
+	viper.SetDefault("CONNECTOR.PUBLIC_URL", "")
+	viper.SetDefault("CONNECTOR.BEARER_TOKEN", "")
+	viper.SetDefault("SMC.API_VERSION", "auto")
+	viper.SetDefault("SMC.PORT", "8082")
+	viper.SetDefault("SMC.NAME", "smc")
+	viper.SetDefault("SMC.SCHEME", "http")
+	viper.SetDefault("SMC.REQUEST_TIMEOUT_IN_SECONDS", 60)
+	viper.SetDefault("SMC.SYNC_TIMEOUT_IN_MINUTES", 30)
+	viper.SetDefault("SMC.STARTUP_TIMEOUT_IN_SECONDS", 300)
+	viper.SetDefault("SMC.RETRY_ATTEMPTS", 3)
+	viper.SetDefault("SMC.RETRY_BASE_DELAY_IN_MILLISECONDS", 500)
+	viper.SetDefault("SMC.RETRY_MAX_DELAY_IN_SECONDS", 10)
+	viper.SetDefault("SMC.CIRCUIT_BREAKER_FAILURES", 5)
+	viper.SetDefault("SMC.CIRCUIT_BREAKER_COOLDOWN_IN_SECONDS", 30)
+	viper.SetDefault("SMC.USER_CACHE_TIME_IN_SECONDS", 60)
+	viper.SetDefault("SMC.DEFAULT_DOMAIN", "Shared Domain")
+	viper.SetDefault("SMC.DEFAULT_GRANTED_ELEMENTS", "ALL Elements")
+	viper.SetDefault("APP_NAME", "")
+	viper.SetDefault("IDENTITY_SOURCE", "azure")
+	viper.SetDefault("LDAP_USERS_OU", "AADDC Users")
+	viper.SetDefault("LDAP_LOOKUP_RETRIES", 0)
+	viper.SetDefault("LDAP_LOOKUP_RETRY_DELAY_IN_SECONDS", 30)
+	viper.SetDefault("LDAP.USER_NAME_ATTRIBUTE", "sAMAccountName")
+	viper.SetDefault("LDAP.GROUP_NAME_ATTRIBUTE", "cn")
+	viper.SetDefault("LDAP.PAGE_SIZE", 500)
+	viper.SetDefault("LDAP.START_TLS", true)
+	viper.SetDefault("LDAP.ALLOW_CLEARTEXT_BIND", false)
+	viper.SetDefault("AZURE.GRAPH_URL", "https://graph.microsoft.com")
+	viper.SetDefault("AZURE.LOGIN_URL", "https://login.microsoftonline.com")
+	viper.SetDefault("AZURE.SYNC_STATE_FILE", "graph_sync_state.json")
+}
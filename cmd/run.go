@@ -1,6 +1,7 @@
 package cmd
 
 import (
+	"context"
 	"fmt"
 	"github.com/gorilla/mux"
 	"github.com/sirupsen/logrus"
@@ -26,35 +27,58 @@ var runCmd = &cobra.Command{
 			os.Exit(1)
 
 		}
+		if viper.GetString("CONNECTOR.BEARER_TOKEN") == "" {
+			logrus.Warn("CONNECTOR.BEARER_TOKEN is empty, the SCIM resources are served without authentication")
+		}
+		mappings, err := LoadRoleMappings()
+		if err != nil {
+			logrus.Error(err)
+			fmt.Print("service is terminated: ")
+			os.Exit(1)
+		}
+		// the API version is negotiated and the mapped roles are checked against the roles of SMC before the service
+		// serves. an SMC which is not compatible or not reachable until SMC.STARTUP_TIMEOUT_IN_SECONDS stops the service
+		if err := ValidateRoleMappingsOnSmc(mappings); err != nil {
+			logrus.Errorf("%s. Please address this issue and rerun the service", err)
+			fmt.Print("service is terminated: ")
+			os.Exit(1)
+		}
 
-		c := make(chan os.Signal)
+		c := make(chan os.Signal, 1)
 		signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 		go func() {
 			<-c
 			fmt.Printf("\nCTRL-C: ")
+			if err := smcSession.Close(); err != nil {
+				logrus.Errorf("failed in logging out from SMC: %s", err)
+			}
 			os.Exit(1)
 		}()
 		go func() {
-			var AzureCLIInstance AzureCLI
-			// get app assigned users
-			if !AzureCLIInstance.IsLogin {
-				if err := AzureCLIInstance.Login(); err != nil {
-					logrus.Fatal(err)
-				}
-				logrus.Info("login to azure.... Done")
+			source, err := NewIdentitySourceFromConfig()
+			if err != nil {
+				logrus.Errorf("the roles and the deleted users are not synced: %s", err)
+				return
 			}
 			for {
-
 				time.Sleep(time.Duration(viper.GetInt("ROLES_UPDATE_TIME_IN_MINUTES")) * time.Minute)
-				ApplyRoles()
-				if err := DetectDeletedUsers(); err != nil {
+				// failures are logged and retried in the next run, SMC or the identity source being down must not
+				// stop the service
+				// each run is limited to SMC.SYNC_TIMEOUT_IN_MINUTES, each request to SMC to SMC.REQUEST_TIMEOUT_IN_SECONDS
+				ctx, cancel := context.WithTimeout(context.Background(),
+					time.Duration(viper.GetInt("SMC.SYNC_TIMEOUT_IN_MINUTES"))*time.Minute)
+				if err := ApplyRoles(ctx, source, mappings); err != nil {
+					logrus.Errorf("failed in applying the roles: %s", err)
+				}
+				if err := DetectDeletedUsers(ctx, source); err != nil {
 					logrus.Error(err)
 				}
+				cancel()
 			}
 		}()
 		muxRouter := mux.NewRouter().StrictSlash(true)
 		router := AddRoutes(muxRouter)
-		err := http.ListenAndServe(viper.GetString("CONNECTOR.HOSTNAME")+":"+viper.GetString("CONNECTOR.PORT"),
+		err = http.ListenAndServe(viper.GetString("CONNECTOR.HOSTNAME")+":"+viper.GetString("CONNECTOR.PORT"),
 			router)
 		if err != nil {
 			log.Fatal(err.Error())
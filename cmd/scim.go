@@ -0,0 +1,195 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/spf13/viper"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	scimUserSchema         = "urn:ietf:params:scim:schemas:core:2.0:User"
+	scimListResponseSchema = "urn:ietf:params:scim:api:messages:2.0:ListResponse"
+	scimPatchOpSchema      = "urn:ietf:params:scim:api:messages:2.0:PatchOp"
+	scimErrorSchema        = "urn:ietf:params:scim:api:messages:2.0:Error"
+	scimContentType        = "application/scim+json"
+	scimGroupSchema        = "urn:ietf:params:scim:schemas:core:2.0:Group"
+	scimUsersPath          = "/scim/v2/Users"
+	scimGroupsPath         = "/scim/v2/Groups"
+)
+
+type ScimMeta struct {
+	ResourceType string `json:"resourceType"`
+	Location     string `json:"location,omitempty"`
+}
+
+type ScimMultiValue struct {
+	Value   string `json:"value"`
+	Ref     string `json:"$ref,omitempty"`
+	Display string `json:"display,omitempty"`
+	Type    string `json:"type,omitempty"`
+	Primary bool   `json:"primary,omitempty"`
+}
+
+// a SCIM core User resource, as it is exchanged with the identity provider
+type ScimUser struct {
+	Schemas     []string         `json:"schemas"`
+	Id          string           `json:"id,omitempty"`
+	ExternalId  string           `json:"externalId,omitempty"`
+	UserName    string           `json:"userName"`
+	DisplayName string           `json:"displayName,omitempty"`
+	Active      bool             `json:"active"`
+	Emails      []ScimMultiValue `json:"emails,omitempty"`
+	Roles       []ScimMultiValue `json:"roles,omitempty"`
+	Meta        *ScimMeta        `json:"meta,omitempty"`
+}
+
+// a SCIM core Group resource, each group is a SMC role and its members are the admins having the role
+type ScimGroup struct {
+	Schemas     []string         `json:"schemas"`
+	Id          string           `json:"id,omitempty"`
+	DisplayName string           `json:"displayName"`
+	Members     []ScimMultiValue `json:"members,omitempty"`
+	Meta        *ScimMeta        `json:"meta,omitempty"`
+}
+
+type ScimListResponse struct {
+	Schemas      []string    `json:"schemas"`
+	TotalResults int         `json:"totalResults"`
+	StartIndex   int         `json:"startIndex"`
+	ItemsPerPage int         `json:"itemsPerPage"`
+	Resources    interface{} `json:"Resources"`
+}
+
+type ScimPatchRequest struct {
+	Schemas    []string    `json:"schemas"`
+	Operations []Operation `json:"Operations"`
+}
+
+type ScimErrorResponse struct {
+	Schemas  []string `json:"schemas"`
+	Status   string   `json:"status"`
+	ScimType string   `json:"scimType,omitempty"`
+	Detail   string   `json:"detail,omitempty"`
+}
+
+// the SCIM id of an SMC admin is the unique id of its LDAP user, admins without LDAP user use their name
+func scimUserId(u UserInfo) string {
+	if id := ldapUserId(u.LdapUser); id != "" {
+		return id
+	}
+	return u.Name
+}
+
+// convert a SMC admin to a SCIM User resource. roleNames maps the href of the SMC roles to their names
+func toScimUser(u UserInfo, roleNames map[string]string) ScimUser {
+	id := scimUserId(u)
+	displayName := u.Comment
+	if displayName == "" {
+		displayName = u.Name
+	}
+	var roles []ScimMultiValue
+	for _, p := range u.Permissions["permission"] {
+		if name, ok := roleNames[p.RoleRef]; ok {
+			roles = append(roles, ScimMultiValue{Value: name})
+		}
+	}
+	return ScimUser{
+		Schemas:     []string{scimUserSchema},
+		Id:          id,
+		UserName:    u.Name,
+		DisplayName: displayName,
+		Active:      u.Enable,
+		Roles:       roles,
+		Meta: &ScimMeta{
+			ResourceType: "User",
+			Location:     connectorUrl(scimUsersPath + "/" + id),
+		},
+	}
+}
+
+// the SCIM id of a SMC role is the key of the role
+func scimGroupId(roleUrl string) string {
+	parts := strings.Split(roleUrl, "/")
+	return parts[len(parts)-1]
+}
+
+// convert a SMC role to a SCIM Group resource
+func toScimGroup(roleName string, roleUrl string, members []ScimMultiValue) ScimGroup {
+	id := scimGroupId(roleUrl)
+	return ScimGroup{
+		Schemas:     []string{scimGroupSchema},
+		Id:          id,
+		DisplayName: roleName,
+		Members:     members,
+		Meta: &ScimMeta{
+			ResourceType: "Group",
+			Location:     connectorUrl(scimGroupsPath + "/" + id),
+		},
+	}
+}
+
+// read the startIndex and count parameters of a list request (RFC 7644 section 3.4.2.4). startIndex is 1-based and
+// count is limited to scimMaxResults
+func scimPagination(r *http.Request) (int, int, error) {
+	startIndex := 1
+	count := scimMaxResults
+	query := r.URL.Query()
+	if v := query.Get("startIndex"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return 0, 0, invalidValueError("invalid startIndex %q", v)
+		}
+		if n > 1 {
+			startIndex = n
+		}
+	}
+	if v := query.Get("count"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return 0, 0, invalidValueError("invalid count %q", v)
+		}
+		if n < 0 {
+			n = 0
+		}
+		if n < count {
+			count = n
+		}
+	}
+	return startIndex, count, nil
+}
+
+// the bounds of a page of a list of the given size
+func pageBounds(size int, startIndex int, count int) (int, int) {
+	from := startIndex - 1
+	if from > size {
+		from = size
+	}
+	to := from + count
+	if to > size {
+		to = size
+	}
+	return from, to
+}
+
+// build a list response holding one page of resources
+func scimListResponse(total int, startIndex int, page interface{}, itemsPerPage int) ScimListResponse {
+	return ScimListResponse{
+		Schemas:      []string{scimListResponseSchema},
+		TotalResults: total,
+		StartIndex:   startIndex,
+		ItemsPerPage: itemsPerPage,
+		Resources:    page,
+	}
+}
+
+// build an absolute url of the connector for the given path. the SCIM clients reach the connector at
+// CONNECTOR.PUBLIC_URL, usually the https URL of the reverse proxy in front of it, or at the address it listens on
+func connectorUrl(path string) string {
+	if publicUrl := viper.GetString("CONNECTOR.PUBLIC_URL"); publicUrl != "" {
+		return strings.TrimSuffix(publicUrl, "/") + path
+	}
+	return fmt.Sprintf("http://%s:%s%s",
+		viper.GetString("connector.hostname"), viper.GetString("connector.port"), path)
+}
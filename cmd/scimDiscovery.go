@@ -0,0 +1,354 @@
+package cmd
+
+import (
+	"crypto/subtle"
+	"github.com/gorilla/mux"
+	"github.com/spf13/viper"
+	"net/http"
+	"strings"
+)
+
+const (
+	scimServiceProviderConfigSchema = "urn:ietf:params:scim:schemas:core:2.0:ServiceProviderConfig"
+	scimResourceTypeSchema          = "urn:ietf:params:scim:schemas:core:2.0:ResourceType"
+	scimSchemaSchema                = "urn:ietf:params:scim:schemas:core:2.0:Schema"
+	scimBasePath                    = "/scim/v2"
+)
+
+// a SCIM attribute definition (RFC 7643 section 7)
+type ScimAttribute struct {
+	Name          string          `json:"name"`
+	Type          string          `json:"type"`
+	MultiValued   bool            `json:"multiValued"`
+	Description   string          `json:"description,omitempty"`
+	Required      bool            `json:"required"`
+	CaseExact     bool            `json:"caseExact"`
+	Mutability    string          `json:"mutability"`
+	Returned      string          `json:"returned"`
+	Uniqueness    string          `json:"uniqueness"`
+	SubAttributes []ScimAttribute `json:"subAttributes,omitempty"`
+}
+
+type ScimSchema struct {
+	Schemas     []string        `json:"schemas"`
+	Id          string          `json:"id"`
+	Name        string          `json:"name"`
+	Description string          `json:"description"`
+	Attributes  []ScimAttribute `json:"attributes"`
+	Meta        *ScimMeta       `json:"meta"`
+}
+
+type ScimResourceType struct {
+	Schemas     []string  `json:"schemas"`
+	Id          string    `json:"id"`
+	Name        string    `json:"name"`
+	Endpoint    string    `json:"endpoint"`
+	Description string    `json:"description"`
+	Schema      string    `json:"schema"`
+	Meta        *ScimMeta `json:"meta"`
+}
+
+type ScimSupported struct {
+	Supported bool `json:"supported"`
+}
+
+type ScimBulk struct {
+	Supported      bool `json:"supported"`
+	MaxOperations  int  `json:"maxOperations"`
+	MaxPayloadSize int  `json:"maxPayloadSize"`
+}
+
+type ScimFilterSupport struct {
+	Supported  bool `json:"supported"`
+	MaxResults int  `json:"maxResults"`
+}
+
+type ScimAuthenticationScheme struct {
+	Type        string `json:"type"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Primary     bool   `json:"primary,omitempty"`
+}
+
+type ScimServiceProviderConfig struct {
+	Schemas               []string                   `json:"schemas"`
+	Patch                 ScimSupported              `json:"patch"`
+	Bulk                  ScimBulk                   `json:"bulk"`
+	Filter                ScimFilterSupport          `json:"filter"`
+	ChangePassword        ScimSupported              `json:"changePassword"`
+	Sort                  ScimSupported              `json:"sort"`
+	Etag                  ScimSupported              `json:"etag"`
+	AuthenticationSchemes []ScimAuthenticationScheme `json:"authenticationSchemes"`
+	Meta                  *ScimMeta                  `json:"meta"`
+}
+
+// an operation of a SCIM resource type. the pattern is relative to the endpoint of the resource type
+type scimOperation struct {
+	name        string
+	method      string
+	pattern     string
+	handlerFunc http.HandlerFunc
+}
+
+// a resource type served by the connector
+type scimResource struct {
+	name        string
+	endpoint    string
+	description string
+	schema      string
+	attributes  []ScimAttribute
+	operations  []scimOperation
+	// filter expressions are accepted on the list operation
+	filter bool
+}
+
+// the attributes of the SCIM users, the paths of PATCH operations are checked against them
+var scimUserAttributes = []ScimAttribute{
+	stringAttribute("userName", "the name of the SMC admin, emails are reduced to their local part",
+		true, "readWrite", "server"),
+	stringAttribute("displayName", "stored as the comment of the SMC admin", false, "readWrite", "none"),
+	{Name: "active", Type: "boolean", Description: "whether the SMC admin is enabled",
+		Mutability: "readWrite", Returned: "default", Uniqueness: "none"},
+	{Name: "name", Type: "complex", Description: "accepted and ignored, SMC admins have no attribute to store it",
+		Mutability: "writeOnly", Returned: "never", Uniqueness: "none",
+		SubAttributes: []ScimAttribute{
+			stringAttribute("formatted", "", false, "writeOnly", "none"),
+			stringAttribute("familyName", "", false, "writeOnly", "none"),
+			stringAttribute("givenName", "", false, "writeOnly", "none"),
+		}},
+	{Name: "emails", Type: "complex", MultiValued: true,
+		Description: "accepted and ignored, SMC admins have no attribute to store an email",
+		Mutability:  "writeOnly", Returned: "never", Uniqueness: "none",
+		SubAttributes: []ScimAttribute{
+			stringAttribute("value", "", false, "writeOnly", "none"),
+			stringAttribute("type", "", false, "writeOnly", "none"),
+			{Name: "primary", Type: "boolean", Mutability: "writeOnly", Returned: "never", Uniqueness: "none"},
+		}},
+	{Name: "roles", Type: "complex", MultiValued: true, Description: "the names of the SMC roles of the admin",
+		Mutability: "readWrite", Returned: "default", Uniqueness: "none",
+		SubAttributes: []ScimAttribute{
+			stringAttribute("value", "the name of a SMC role", false, "readWrite", "none"),
+			stringAttribute("display", "", false, "readWrite", "none"),
+			stringAttribute("type", "", false, "readWrite", "none"),
+			{Name: "primary", Type: "boolean", Mutability: "readWrite", Returned: "default", Uniqueness: "none"},
+		}},
+}
+
+// the attributes of the SCIM groups
+var scimGroupAttributes = []ScimAttribute{
+	stringAttribute("displayName", "the name of the SMC role", true, "readOnly", "server"),
+	{Name: "members", Type: "complex", MultiValued: true, Description: "the SMC admins having the role",
+		Mutability: "readWrite", Returned: "default", Uniqueness: "none",
+		SubAttributes: []ScimAttribute{
+			stringAttribute("value", "the id of the SMC admin", false, "immutable", "none"),
+			{Name: "$ref", Type: "reference", Mutability: "immutable", Returned: "default",
+				Uniqueness: "none"},
+			stringAttribute("display", "the name of the SMC admin", false, "readOnly", "none"),
+		}},
+}
+
+// the registry of the SCIM resource types. the SCIM routes and the discovery endpoints are generated from it
+var scimResources = []scimResource{
+	{
+		name:        "User",
+		endpoint:    scimUsersPath,
+		description: "SMC administrators",
+		schema:      scimUserSchema,
+		filter:      true,
+		attributes:  scimUserAttributes,
+		operations: []scimOperation{
+			{"ScimGetUsers", "GET", "", ScimGetUsers},
+			{"ScimGetUser", "GET", "/{id}", ScimGetUser},
+			{"ScimCreateUser", "POST", "", ScimCreateUser},
+			{"ScimReplaceUser", "PUT", "/{id}", ScimReplaceUser},
+			{"ScimPatchUser", "PATCH", "/{id}", ScimPatchUser},
+			{"ScimDeleteUser", "DELETE", "/{id}", ScimDeleteUser},
+		},
+	},
+	{
+		name:        "Group",
+		endpoint:    scimGroupsPath,
+		description: "SMC roles, members of a group are granted the role",
+		schema:      scimGroupSchema,
+		filter:      true,
+		attributes:  scimGroupAttributes,
+		operations: []scimOperation{
+			{"ScimGetGroups", "GET", "", ScimGetGroups},
+			{"ScimGetGroup", "GET", "/{id}", ScimGetGroup},
+			{"ScimPatchGroup", "PATCH", "/{id}", ScimPatchGroup},
+		},
+	},
+}
+
+// the maximum number of resources returned in one response
+const scimMaxResults = 200
+
+func stringAttribute(name string, description string, required bool, mutability string,
+	uniqueness string) ScimAttribute {
+	return ScimAttribute{
+		Name:        name,
+		Type:        "string",
+		Description: description,
+		Required:    required,
+		Mutability:  mutability,
+		Returned:    "default",
+		Uniqueness:  uniqueness,
+	}
+}
+
+// the routes of the SCIM resources and of the discovery endpoints
+func scimRoutes() []Route {
+	routes := []Route{
+		{"ScimServiceProviderConfig", "GET", scimBasePath + "/ServiceProviderConfig", ScimGetServiceProviderConfig},
+		{"ScimGetSchemas", "GET", scimBasePath + "/Schemas", ScimGetSchemas},
+		{"ScimGetSchema", "GET", scimBasePath + "/Schemas/{id}", ScimGetSchema},
+		{"ScimGetResourceTypes", "GET", scimBasePath + "/ResourceTypes", ScimGetResourceTypes},
+		{"ScimGetResourceType", "GET", scimBasePath + "/ResourceTypes/{id}", ScimGetResourceType},
+	}
+	for _, resource := range scimResources {
+		for _, op := range resource.operations {
+			routes = append(routes, Route{
+				Name:        op.name,
+				Method:      op.method,
+				Pattern:     resource.endpoint + op.pattern,
+				HandlerFunc: requireScimBearerToken(op.handlerFunc),
+			})
+		}
+	}
+	return routes
+}
+
+// describe the features of the connector, as they are registered in scimResources
+func serviceProviderConfig() ScimServiceProviderConfig {
+	patch := false
+	filter := false
+	for _, resource := range scimResources {
+		filter = filter || resource.filter
+		for _, op := range resource.operations {
+			patch = patch || op.method == "PATCH"
+		}
+	}
+	return ScimServiceProviderConfig{
+		Schemas:               []string{scimServiceProviderConfigSchema},
+		Patch:                 ScimSupported{Supported: patch},
+		Bulk:                  ScimBulk{Supported: false},
+		Filter:                ScimFilterSupport{Supported: filter, MaxResults: scimMaxResults},
+		AuthenticationSchemes: scimAuthenticationSchemes(),
+		Meta: &ScimMeta{
+			ResourceType: "ServiceProviderConfig",
+			Location:     connectorUrl(scimBasePath + "/ServiceProviderConfig"),
+		},
+	}
+}
+
+// the bearer token is only advertised when CONNECTOR.BEARER_TOKEN is set, the SCIM resources are not authenticated
+// otherwise
+func scimAuthenticationSchemes() []ScimAuthenticationScheme {
+	if viper.GetString("CONNECTOR.BEARER_TOKEN") == "" {
+		return []ScimAuthenticationScheme{}
+	}
+	return []ScimAuthenticationScheme{
+		{
+			Type:        "oauthbearertoken",
+			Name:        "OAuth Bearer Token",
+			Description: "the secret token configured as CONNECTOR.BEARER_TOKEN, sent in the Authorization header",
+			Primary:     true,
+		},
+	}
+}
+
+func scimSchemas() []ScimSchema {
+	var schemas []ScimSchema
+	for _, resource := range scimResources {
+		schemas = append(schemas, ScimSchema{
+			Schemas:     []string{scimSchemaSchema},
+			Id:          resource.schema,
+			Name:        resource.name,
+			Description: resource.description,
+			Attributes:  resource.attributes,
+			Meta: &ScimMeta{
+				ResourceType: "Schema",
+				Location:     connectorUrl(scimBasePath + "/Schemas/" + resource.schema),
+			},
+		})
+	}
+	return schemas
+}
+
+func scimResourceTypes() []ScimResourceType {
+	var resourceTypes []ScimResourceType
+	for _, resource := range scimResources {
+		resourceTypes = append(resourceTypes, ScimResourceType{
+			Schemas:     []string{scimResourceTypeSchema},
+			Id:          resource.name,
+			Name:        resource.name,
+			Endpoint:    strings.TrimPrefix(resource.endpoint, scimBasePath),
+			Description: resource.description,
+			Schema:      resource.schema,
+			Meta: &ScimMeta{
+				ResourceType: "ResourceType",
+				Location:     connectorUrl(scimBasePath + "/ResourceTypes/" + resource.name),
+			},
+		})
+	}
+	return resourceTypes
+}
+
+func ScimGetServiceProviderConfig(w http.ResponseWriter, r *http.Request) {
+	writeScimResponse(w, r, http.StatusOK, serviceProviderConfig())
+}
+
+func ScimGetSchemas(w http.ResponseWriter, r *http.Request) {
+	schemas := scimSchemas()
+	writeScimResponse(w, r, http.StatusOK, scimListResponse(len(schemas), 1, schemas, len(schemas)))
+}
+
+func ScimGetSchema(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	for _, schema := range scimSchemas() {
+		if schema.Id == id {
+			writeScimResponse(w, r, http.StatusOK, schema)
+			return
+		}
+	}
+	handleScimError(w, r, notFoundError("the given schema: %s not found", id))
+}
+
+func ScimGetResourceTypes(w http.ResponseWriter, r *http.Request) {
+	resourceTypes := scimResourceTypes()
+	writeScimResponse(w, r, http.StatusOK, scimListResponse(len(resourceTypes), 1, resourceTypes,
+		len(resourceTypes)))
+}
+
+func ScimGetResourceType(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	for _, resourceType := range scimResourceTypes() {
+		if strings.EqualFold(resourceType.Id, id) {
+			writeScimResponse(w, r, http.StatusOK, resourceType)
+			return
+		}
+	}
+	handleScimError(w, r, notFoundError("the given resource type: %s not found", id))
+}
+
+// serve the requests of a SCIM resource only when they carry the bearer token CONNECTOR.BEARER_TOKEN. the discovery
+// endpoints describe the connector only and are served without token
+func requireScimBearerToken(handlerFunc http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := viper.GetString("CONNECTOR.BEARER_TOKEN")
+		if token == "" {
+			handlerFunc(w, r)
+			return
+		}
+		authorization := r.Header.Get("Authorization")
+		const prefix = "bearer "
+		if len(authorization) < len(prefix) || !strings.EqualFold(authorization[:len(prefix)], prefix) ||
+			subtle.ConstantTimeCompare([]byte(strings.TrimSpace(authorization[len(prefix):])), []byte(token)) != 1 {
+			loggerWithField(r).Warn("rejected a SCIM request without a valid bearer token")
+			w.Header().Set("WWW-Authenticate", `Bearer realm="SCIM"`)
+			writeScimError(w, r, http.StatusUnauthorized, "", "a valid bearer token is required")
+			return
+		}
+		handlerFunc(w, r)
+	}
+}
@@ -0,0 +1,140 @@
+package cmd
+
+import (
+	"encoding/json"
+	"github.com/spf13/viper"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestScimServiceProviderConfig(t *testing.T) {
+	viper.Reset()
+	setConfigDefaults()
+	viper.Set("CONNECTOR.PUBLIC_URL", "https://scim.contoso.com")
+
+	for _, token := range []string{"", "secret"} {
+		viper.Set("CONNECTOR.BEARER_TOKEN", token)
+		response := serveConnector(http.MethodGet, scimBasePath+"/ServiceProviderConfig", "")
+		if response.Code != http.StatusOK {
+			t.Fatalf("got status %d: %s", response.Code, response.Body.String())
+		}
+		var config ScimServiceProviderConfig
+		if err := json.Unmarshal(response.Body.Bytes(), &config); err != nil {
+			t.Fatal(err)
+		}
+		if !config.Patch.Supported || !config.Filter.Supported || config.Filter.MaxResults != scimMaxResults ||
+			config.Bulk.Supported || config.Sort.Supported || config.Etag.Supported || config.ChangePassword.Supported {
+			t.Errorf("token %q: got the config %+v", token, config)
+		}
+		if want := "https://scim.contoso.com" + scimBasePath + "/ServiceProviderConfig"; config.Meta.Location != want {
+			t.Errorf("token %q: got the location %s, want %s", token, config.Meta.Location, want)
+		}
+		schemes := len(config.AuthenticationSchemes)
+		if token == "" && schemes != 0 {
+			t.Errorf("got the authentication schemes %+v without bearer token", config.AuthenticationSchemes)
+		}
+		if token != "" && (schemes != 1 || config.AuthenticationSchemes[0].Type != "oauthbearertoken") {
+			t.Errorf("got the authentication schemes %+v with a bearer token", config.AuthenticationSchemes)
+		}
+	}
+}
+
+func TestScimSchemasAndResourceTypes(t *testing.T) {
+	viper.Reset()
+	setConfigDefaults()
+
+	tests := []struct {
+		target string
+		status int
+		id     string
+	}{
+		{scimBasePath + "/Schemas/" + scimUserSchema, http.StatusOK, scimUserSchema},
+		{scimBasePath + "/Schemas/" + scimGroupSchema, http.StatusOK, scimGroupSchema},
+		{scimBasePath + "/Schemas/urn:ietf:params:scim:schemas:extension:enterprise:2.0:User", http.StatusNotFound, ""},
+		{scimBasePath + "/ResourceTypes/User", http.StatusOK, "User"},
+		{scimBasePath + "/ResourceTypes/group", http.StatusOK, "Group"},
+		{scimBasePath + "/ResourceTypes/Device", http.StatusNotFound, ""},
+	}
+	for _, test := range tests {
+		response := serveConnector(http.MethodGet, test.target, "")
+		if response.Code != test.status {
+			t.Errorf("%s: got status %d, want %d: %s", test.target, response.Code, test.status, response.Body.String())
+			continue
+		}
+		var body struct{ Id string }
+		if err := json.Unmarshal(response.Body.Bytes(), &body); err != nil {
+			t.Fatal(err)
+		}
+		if body.Id != test.id {
+			t.Errorf("%s: got the id %q, want %q", test.target, body.Id, test.id)
+		}
+	}
+
+	// the user schema describes the attributes the PATCH operations are validated against
+	response := serveConnector(http.MethodGet, scimBasePath+"/Schemas/"+scimUserSchema, "")
+	var schema ScimSchema
+	if err := json.Unmarshal(response.Body.Bytes(), &schema); err != nil {
+		t.Fatal(err)
+	}
+	if len(schema.Attributes) != len(scimUserAttributes) {
+		t.Errorf("got %d attributes, want %d", len(schema.Attributes), len(scimUserAttributes))
+	}
+
+	response = serveConnector(http.MethodGet, scimBasePath+"/ResourceTypes", "")
+	var list struct {
+		TotalResults int
+		Resources    []ScimResourceType
+	}
+	if err := json.Unmarshal(response.Body.Bytes(), &list); err != nil {
+		t.Fatal(err)
+	}
+	if list.TotalResults != len(scimResources) || len(list.Resources) != len(scimResources) {
+		t.Fatalf("got the resource types %s", response.Body.String())
+	}
+	for i, resourceType := range list.Resources {
+		if resourceType.Endpoint != "/"+resourceType.Name+"s" || resourceType.Schema != scimResources[i].schema {
+			t.Errorf("got the resource type %+v", resourceType)
+		}
+	}
+}
+
+func TestScimBearerToken(t *testing.T) {
+	f := newFakeSmc(t)
+	defer f.Close()
+	viper.Set("CONNECTOR.BEARER_TOKEN", "secret")
+	f.addAdmin("alice", true)
+
+	tests := []struct {
+		target        string
+		authorization string
+		status        int
+	}{
+		{scimUsersPath, "", http.StatusUnauthorized},
+		{scimUsersPath, "Bearer wrong", http.StatusUnauthorized},
+		{scimUsersPath, "Basic secret", http.StatusUnauthorized},
+		{scimUsersPath, "Bearer secretsecret", http.StatusUnauthorized},
+		{scimUsersPath, "Bearer secret", http.StatusOK},
+		{scimUsersPath + "/id-alice", "bearer secret", http.StatusOK},
+		{scimGroupsPath, "", http.StatusUnauthorized},
+		{scimBasePath + "/ServiceProviderConfig", "", http.StatusOK},
+	}
+	for _, test := range tests {
+		request := httptest.NewRequest(http.MethodGet, test.target, nil)
+		if test.authorization != "" {
+			request.Header.Set("Authorization", test.authorization)
+		}
+		response := serveConnectorRequest(request)
+		if response.Code != test.status {
+			t.Errorf("%s with %q: got status %d, want %d: %s", test.target, test.authorization, response.Code,
+				test.status, response.Body.String())
+		}
+		if test.status == http.StatusUnauthorized && response.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("%s with %q: got no WWW-Authenticate header", test.target, test.authorization)
+		}
+	}
+	response := serveConnector(http.MethodDelete, scimUsersPath+"/id-alice", "")
+	if response.Code != http.StatusUnauthorized || f.admin("alice") == nil {
+		t.Errorf("DELETE without token: got status %d", response.Code)
+	}
+}
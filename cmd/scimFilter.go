@@ -0,0 +1,492 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// a parsed SCIM filter expression (RFC 7644 section 3.4.2.2), evaluated against a resource decoded to a map
+type scimFilter interface {
+	matches(resource map[string]interface{}) bool
+}
+
+type scimFilterError struct {
+	detail string
+}
+
+func (e *scimFilterError) Error() string {
+	return "invalid filter: " + e.detail
+}
+
+// attrPath op value, or attrPath pr
+type attributeExpression struct {
+	path     string
+	operator string
+	value    interface{}
+}
+
+// filter and filter, filter or filter
+type logicalExpression struct {
+	operator string
+	left     scimFilter
+	right    scimFilter
+}
+
+// not (filter)
+type notExpression struct {
+	expression scimFilter
+}
+
+// attrPath[filter], matches when at least one value of a multi-valued attribute matches the inner filter
+type valuePathExpression struct {
+	path   string
+	filter scimFilter
+}
+
+var supportedFilterOperators = map[string]bool{"eq": true, "ne": true, "co": true, "sw": true, "ew": true, "pr": true,
+	"gt": true, "ge": true, "lt": true, "le": true}
+
+// the operators ordering the values, strings are compared lexicographically and numbers numerically
+var orderingFilterOperators = map[string]bool{"gt": true, "ge": true, "lt": true, "le": true}
+
+// parse a SCIM filter expression
+func parseScimFilter(filter string) (scimFilter, error) {
+	tokens, err := tokenizeFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, &scimFilterError{"the filter is empty"}
+	}
+	p := &filterParser{tokens: tokens}
+	expression, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if !p.done() {
+		return nil, &scimFilterError{fmt.Sprintf("unexpected token %q", p.peek().text)}
+	}
+	return expression, nil
+}
+
+type filterToken struct {
+	text   string
+	quoted bool
+}
+
+func tokenizeFilter(filter string) ([]filterToken, error) {
+	var tokens []filterToken
+	runes := []rune(filter)
+	for i := 0; i < len(runes); {
+		c := runes[i]
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case strings.ContainsRune("()[]", c):
+			tokens = append(tokens, filterToken{text: string(c)})
+			i++
+		case c == '"':
+			// keep the JSON escaping and let the JSON decoder unquote the string
+			j := i + 1
+			for ; j < len(runes) && runes[j] != '"'; j++ {
+				if runes[j] == '\\' {
+					j++
+				}
+			}
+			if j >= len(runes) {
+				return nil, &scimFilterError{"unterminated string"}
+			}
+			var value string
+			if err := json.Unmarshal([]byte(string(runes[i:j+1])), &value); err != nil {
+				return nil, &scimFilterError{fmt.Sprintf("invalid string %s", string(runes[i:j+1]))}
+			}
+			tokens = append(tokens, filterToken{text: value, quoted: true})
+			i = j + 1
+		default:
+			j := i
+			for ; j < len(runes) && !unicode.IsSpace(runes[j]) && !strings.ContainsRune("()[]\"", runes[j]); j++ {
+			}
+			tokens = append(tokens, filterToken{text: string(runes[i:j])})
+			i = j
+		}
+	}
+	return tokens, nil
+}
+
+type filterParser struct {
+	tokens []filterToken
+	pos    int
+}
+
+func (p *filterParser) done() bool {
+	return p.pos >= len(p.tokens)
+}
+
+func (p *filterParser) peek() filterToken {
+	if p.done() {
+		return filterToken{}
+	}
+	return p.tokens[p.pos]
+}
+
+func (p *filterParser) next() filterToken {
+	t := p.peek()
+	p.pos++
+	return t
+}
+
+// check if the next token is the given keyword or punctuation
+func (p *filterParser) peekKeyword(keyword string) bool {
+	t := p.peek()
+	return !p.done() && !t.quoted && strings.EqualFold(t.text, keyword)
+}
+
+func (p *filterParser) expect(keyword string) error {
+	if !p.peekKeyword(keyword) {
+		if p.done() {
+			return &scimFilterError{fmt.Sprintf("expected %q but the filter ended", keyword)}
+		}
+		return &scimFilterError{fmt.Sprintf("expected %q but found %q", keyword, p.peek().text)}
+	}
+	p.pos++
+	return nil
+}
+
+func (p *filterParser) parseOr() (scimFilter, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.peekKeyword("or") {
+		p.pos++
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &logicalExpression{operator: "or", left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *filterParser) parseAnd() (scimFilter, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.peekKeyword("and") {
+		p.pos++
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = &logicalExpression{operator: "and", left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *filterParser) parseNot() (scimFilter, error) {
+	if p.peekKeyword("not") {
+		p.pos++
+		expression, err := p.parseGroup()
+		if err != nil {
+			return nil, err
+		}
+		return &notExpression{expression: expression}, nil
+	}
+	if p.peekKeyword("(") {
+		return p.parseGroup()
+	}
+	return p.parseAttribute()
+}
+
+func (p *filterParser) parseGroup() (scimFilter, error) {
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+	expression, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect(")"); err != nil {
+		return nil, err
+	}
+	return expression, nil
+}
+
+func (p *filterParser) parseAttribute() (scimFilter, error) {
+	if p.done() {
+		return nil, &scimFilterError{"expected an attribute but the filter ended"}
+	}
+	t := p.next()
+	if t.quoted || strings.ContainsAny(t.text, "()[]") {
+		return nil, &scimFilterError{fmt.Sprintf("expected an attribute but found %q", t.text)}
+	}
+	path := normalizeAttributePath(t.text)
+	if p.peekKeyword("[") {
+		p.pos++
+		inner, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect("]"); err != nil {
+			return nil, err
+		}
+		return &valuePathExpression{path: path, filter: inner}, nil
+	}
+	if p.done() {
+		return nil, &scimFilterError{fmt.Sprintf("missing operator after %q", t.text)}
+	}
+	operator := strings.ToLower(p.next().text)
+	if !supportedFilterOperators[operator] {
+		return nil, &scimFilterError{fmt.Sprintf("unsupported operator %q", operator)}
+	}
+	if operator == "pr" {
+		return &attributeExpression{path: path, operator: operator}, nil
+	}
+	if p.done() {
+		return nil, &scimFilterError{fmt.Sprintf("missing value after %q", operator)}
+	}
+	value, err := filterValue(p.next())
+	if err != nil {
+		return nil, err
+	}
+	switch value.(type) {
+	case string:
+	case float64:
+		if !orderingFilterOperators[operator] && operator != "eq" && operator != "ne" {
+			return nil, &scimFilterError{fmt.Sprintf("the operator %q requires a string value", operator)}
+		}
+	default:
+		if operator != "eq" && operator != "ne" {
+			return nil, &scimFilterError{fmt.Sprintf("the operator %q requires a string or number value", operator)}
+		}
+	}
+	return &attributeExpression{path: path, operator: operator, value: value}, nil
+}
+
+// convert a comparison value token to a string, bool, number or nil
+func filterValue(t filterToken) (interface{}, error) {
+	if t.quoted {
+		return t.text, nil
+	}
+	switch strings.ToLower(t.text) {
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	case "null":
+		return nil, nil
+	}
+	if n, err := strconv.ParseFloat(t.text, 64); err == nil {
+		return n, nil
+	}
+	return nil, &scimFilterError{fmt.Sprintf("invalid value %q", t.text)}
+}
+
+// strip the schema URN from a fully qualified attribute path
+func normalizeAttributePath(path string) string {
+	if strings.HasPrefix(strings.ToLower(path), "urn:") {
+		if i := strings.LastIndex(path, ":"); i != -1 {
+			return path[i+1:]
+		}
+	}
+	return path
+}
+
+func (e *logicalExpression) matches(resource map[string]interface{}) bool {
+	if e.operator == "and" {
+		return e.left.matches(resource) && e.right.matches(resource)
+	}
+	return e.left.matches(resource) || e.right.matches(resource)
+}
+
+func (e *notExpression) matches(resource map[string]interface{}) bool {
+	return !e.expression.matches(resource)
+}
+
+func (e *valuePathExpression) matches(resource map[string]interface{}) bool {
+	for _, v := range rawAttributeValues(resource, e.path) {
+		if element, ok := v.(map[string]interface{}); ok && e.filter.matches(element) {
+			return true
+		}
+	}
+	return false
+}
+
+func (e *attributeExpression) matches(resource map[string]interface{}) bool {
+	values := attributeValues(resource, e.path)
+	switch e.operator {
+	case "pr":
+		for _, v := range values {
+			if v != nil && v != "" {
+				return true
+			}
+		}
+		return false
+	case "ne":
+		return !(&attributeExpression{path: e.path, operator: "eq", value: e.value}).matches(resource)
+	case "eq":
+		if e.value == nil {
+			return len(values) == 0
+		}
+	}
+	for _, v := range values {
+		if compareFilterValue(e.operator, v, e.value) {
+			return true
+		}
+	}
+	return false
+}
+
+func compareFilterValue(operator string, actual interface{}, expected interface{}) bool {
+	actualString, actualIsString := actual.(string)
+	expectedString, expectedIsString := expected.(string)
+	if actualIsString && expectedIsString {
+		actualString = strings.ToLower(actualString)
+		expectedString = strings.ToLower(expectedString)
+		switch operator {
+		case "eq":
+			return actualString == expectedString
+		case "co":
+			return strings.Contains(actualString, expectedString)
+		case "sw":
+			return strings.HasPrefix(actualString, expectedString)
+		case "ew":
+			return strings.HasSuffix(actualString, expectedString)
+		}
+		return compareOrder(operator, strings.Compare(actualString, expectedString))
+	}
+	actualNumber, actualIsNumber := actual.(float64)
+	expectedNumber, expectedIsNumber := expected.(float64)
+	if actualIsNumber && expectedIsNumber && orderingFilterOperators[operator] {
+		switch {
+		case actualNumber < expectedNumber:
+			return compareOrder(operator, -1)
+		case actualNumber > expectedNumber:
+			return compareOrder(operator, 1)
+		}
+		return compareOrder(operator, 0)
+	}
+	return operator == "eq" && actual == expected
+}
+
+// check the result of a comparison, -1, 0 or 1, against an ordering operator
+func compareOrder(operator string, order int) bool {
+	switch operator {
+	case "gt":
+		return order > 0
+	case "ge":
+		return order >= 0
+	case "lt":
+		return order < 0
+	case "le":
+		return order <= 0
+	}
+	return false
+}
+
+// collect the values of a (case insensitive, dotted) attribute path. multi-valued attributes are flattened and
+// complex values without a sub-attribute are compared by their "value" sub-attribute
+func attributeValues(resource map[string]interface{}, path string) []interface{} {
+	var values []interface{}
+	for _, v := range rawAttributeValues(resource, path) {
+		if m, ok := v.(map[string]interface{}); ok {
+			if value, ok := lookupAttribute(m, "value"); ok {
+				values = append(values, value)
+			}
+			continue
+		}
+		if v != nil {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+// collect the values of a (case insensitive, dotted) attribute path as they are stored in the resource
+func rawAttributeValues(resource map[string]interface{}, path string) []interface{} {
+	current := []interface{}{resource}
+	for _, name := range strings.Split(path, ".") {
+		var found []interface{}
+		for _, c := range current {
+			if m, ok := c.(map[string]interface{}); ok {
+				if v, ok := lookupAttribute(m, name); ok {
+					found = append(found, flattenValue(v)...)
+				}
+			}
+		}
+		current = found
+	}
+	return current
+}
+
+func lookupAttribute(m map[string]interface{}, name string) (interface{}, bool) {
+	if v, ok := m[name]; ok {
+		return v, true
+	}
+	for k, v := range m {
+		if strings.EqualFold(k, name) {
+			return v, true
+		}
+	}
+	return nil, false
+}
+
+func flattenValue(v interface{}) []interface{} {
+	if list, ok := v.([]interface{}); ok {
+		return list
+	}
+	return []interface{}{v}
+}
+
+// decode a resource to the generic map form the filters are evaluated against
+func resourceMap(resource interface{}) (map[string]interface{}, error) {
+	buff, err := json.Marshal(resource)
+	if err != nil {
+		return nil, err
+	}
+	var m map[string]interface{}
+	if err := json.Unmarshal(buff, &m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// return the user name of a filter in the form: userName eq "value", which can be looked up directly in SMC
+func filterUserName(filter scimFilter) (string, bool) {
+	e, ok := filter.(*attributeExpression)
+	if !ok || e.operator != "eq" || !strings.EqualFold(e.path, "userName") {
+		return "", false
+	}
+	name, ok := e.value.(string)
+	return name, ok
+}
+
+// reduce the values compared to userName to the SMC admin name, the local part of a login. Azure AD filters users by
+// their full login, such as userName eq "alice@contoso.com", while the admin is named alice
+func normalizeUserNameFilter(filter scimFilter) {
+	switch e := filter.(type) {
+	case *attributeExpression:
+		if name, ok := e.value.(string); ok && (e.operator == "eq" || e.operator == "ne") &&
+			strings.EqualFold(e.path, "userName") {
+			e.value = loginName(name)
+		}
+	case *logicalExpression:
+		normalizeUserNameFilter(e.left)
+		normalizeUserNameFilter(e.right)
+	case *notExpression:
+		normalizeUserNameFilter(e.expression)
+	}
+}
+
+// match a SCIM user against a filter normalized by normalizeUserNameFilter
+func matchScimUser(filter scimFilter, resource map[string]interface{}) bool {
+	key := attributeKey(resource, "userName")
+	if name, ok := resource[key].(string); ok {
+		resource[key] = loginName(name)
+	}
+	return filter.matches(resource)
+}
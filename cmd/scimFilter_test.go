@@ -0,0 +1,124 @@
+package cmd
+
+import "testing"
+
+func TestMatchScimUserByLogin(t *testing.T) {
+	resource := map[string]interface{}{"userName": "alice", "active": true}
+	tests := []struct {
+		filter  string
+		matches bool
+	}{
+		{`userName eq "alice@contoso.com"`, true},
+		{`userName eq "alice@contoso.com" and active eq true`, true},
+		{`not (userName eq "alice@contoso.com")`, false},
+		{`userName ne "bob@contoso.com"`, true},
+		{`userName eq "bob@contoso.com" or active eq false`, false},
+	}
+	for _, test := range tests {
+		filter, err := parseScimFilter(test.filter)
+		if err != nil {
+			t.Fatalf("%s: %s", test.filter, err)
+		}
+		normalizeUserNameFilter(filter)
+		if got := matchScimUser(filter, resource); got != test.matches {
+			t.Errorf("%s: got %t, want %t", test.filter, got, test.matches)
+		}
+	}
+}
+
+func TestScimFilterOperators(t *testing.T) {
+	resource := map[string]interface{}{
+		"userName": "alice",
+		"active":   true,
+		"title":    nil,
+		"meta":     map[string]interface{}{"version": "W/\"3\"", "count": 5.0},
+		"emails": []interface{}{
+			map[string]interface{}{"type": "work", "value": "alice@contoso.com", "primary": true},
+			map[string]interface{}{"type": "home", "value": "alice@example.org"},
+		},
+		"urn:ietf:params:scim:schemas:extension:enterprise:2.0:User": map[string]interface{}{"department": "IT"},
+	}
+	tests := []struct {
+		filter  string
+		matches bool
+	}{
+		{`userName eq "ALICE"`, true},
+		{`UserName Eq "alice"`, true},
+		{`userName ne "alice"`, false},
+		{`userName co "lic"`, true},
+		{`userName co "bob"`, false},
+		{`userName sw "al"`, true},
+		{`userName sw "ce"`, false},
+		{`userName ew "ICE"`, true},
+		{`userName ew "al"`, false},
+		{`userName pr`, true},
+		{`title pr`, false},
+		{`nickName pr`, false},
+		{`title eq null`, true},
+		{`userName gt "al"`, true},
+		{`userName gt "alice"`, false},
+		{`userName ge "alice"`, true},
+		{`userName lt "bob"`, true},
+		{`userName lt "alice"`, false},
+		{`userName le "ALICE"`, true},
+		{`meta.count gt 4`, true},
+		{`meta.count lt 5`, false},
+		{`meta.count le 5`, true},
+		{`meta.count ge 5.5`, false},
+		{`active eq true`, true},
+		{`active eq false`, false},
+		{`emails co "example.org"`, true},
+		{`emails.type eq "home"`, true},
+		{`emails[type eq "work" and value ew "contoso.com"]`, true},
+		{`emails[type eq "home" and value ew "contoso.com"]`, false},
+		{`emails[type eq "work" and primary eq true]`, true},
+		{`emails[not (type eq "work")]`, true},
+		{`urn:ietf:params:scim:schemas:core:2.0:User:userName eq "alice"`, true},
+		// and binds tighter than or
+		{`userName eq "bob" and active eq true or active eq true`, true},
+		{`userName eq "bob" and (active eq true or active eq true)`, false},
+		{`active eq true or userName eq "bob" and active eq false`, true},
+		{`(active eq true or userName eq "bob") and active eq false`, false},
+		{`not (userName eq "bob") and active eq true`, true},
+		{`not (userName eq "alice" or active eq false)`, false},
+		{`((userName eq "alice"))`, true},
+	}
+	for _, test := range tests {
+		filter, err := parseScimFilter(test.filter)
+		if err != nil {
+			t.Errorf("%s: %s", test.filter, err)
+			continue
+		}
+		if got := filter.matches(resource); got != test.matches {
+			t.Errorf("%s: got %t, want %t", test.filter, got, test.matches)
+		}
+	}
+}
+
+func TestParseInvalidScimFilter(t *testing.T) {
+	for _, filter := range []string{
+		``,
+		`   `,
+		`userName`,
+		`userName eq`,
+		`userName eq "alice`,
+		`userName eq alice`,
+		`userName xx "alice"`,
+		`userName eq "alice" and`,
+		`userName eq "alice" or or active eq true`,
+		`(userName eq "alice"`,
+		`userName eq "alice")`,
+		`not userName eq "alice"`,
+		`emails[type eq "work"`,
+		`emails[type eq "work"]]`,
+		`"userName" eq "alice"`,
+		`userName co 1`,
+		`userName gt true`,
+		`userName sw null`,
+	} {
+		_, err := parseScimFilter(filter)
+		if _, ok := err.(*scimFilterError); !ok {
+			t.Errorf("%q: got %v, want an invalid filter error", filter, err)
+		}
+	}
+}
@@ -0,0 +1,219 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// list the SMC roles as SCIM Group resources
+func ScimGetGroups(w http.ResponseWriter, r *http.Request) {
+	var filter scimFilter
+	query := r.URL.Query().Get("filter")
+	if query != "" {
+		var err error
+		if filter, err = parseScimFilter(query); err != nil {
+			loggerWithField(r).Error(err.Error())
+			handleScimError(w, r, err)
+			return
+		}
+	}
+	startIndex, count, err := scimPagination(r)
+	if err != nil {
+		loggerWithField(r).Error(err.Error())
+		handleScimError(w, r, err)
+		return
+	}
+	excluded := membersExcluded(r)
+	withMembers := !excluded || strings.Contains(strings.ToLower(query), "members")
+	groups, err := loadScimGroups(r.Context(), withMembers)
+	if err != nil {
+		loggerWithField(r).Error(err.Error())
+		handleScimError(w, r, err)
+		return
+	}
+	resources := []ScimGroup{}
+	for _, group := range groups {
+		if filter != nil {
+			resource, err := resourceMap(group)
+			if err != nil {
+				loggerWithField(r).Error(err.Error())
+				handleScimError(w, r, err)
+				return
+			}
+			if !filter.matches(resource) {
+				continue
+			}
+		}
+		if excluded {
+			group.Members = nil
+		}
+		resources = append(resources, group)
+	}
+	from, to := pageBounds(len(resources), startIndex, count)
+	writeScimResponse(w, r, http.StatusOK, scimListResponse(len(resources), startIndex, resources[from:to], to-from))
+	loggerWithField(r).Info("Get SCIM groups")
+}
+
+// get a single SMC role as a SCIM Group resource
+func ScimGetGroup(w http.ResponseWriter, r *http.Request) {
+	excluded := membersExcluded(r)
+	group, err := findScimGroup(r.Context(), mux.Vars(r)["id"], !excluded)
+	if err != nil {
+		loggerWithField(r).Error(err.Error())
+		handleScimError(w, r, err)
+		return
+	}
+	writeScimResponse(w, r, http.StatusOK, group)
+	loggerWithField(r).Infof("Get SCIM group: %s", group.DisplayName)
+}
+
+// apply SCIM PATCH operations on the members of a SMC role, added members are granted the role and removed members
+// lose it. the role mappings win: the roles of the members of mapped groups are set again by ApplyRoles
+func ScimPatchGroup(w http.ResponseWriter, r *http.Request) {
+	var patch ScimPatchRequest
+	if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+		loggerWithField(r).Error(err.Error())
+		handleScimError(w, r, invalidSyntaxError("%s", err.Error()))
+		return
+	}
+	group, err := findScimGroup(r.Context(), mux.Vars(r)["id"], true)
+	if err != nil {
+		loggerWithField(r).Error(err.Error())
+		handleScimError(w, r, err)
+		return
+	}
+	var patched ScimGroup
+	if err := patchScimResource(group, scimGroupAttributes, patch.Operations, &patched); err != nil {
+		loggerWithField(r).Error(err.Error())
+		handleScimError(w, r, err)
+		return
+	}
+	if patched.DisplayName != group.DisplayName {
+		handleScimError(w, r, mutabilityError("the name of a SMC role cannot be changed"))
+		return
+	}
+	if err := applyGroupMembers(r.Context(), group, patched); err != nil {
+		loggerWithField(r).Error(err.Error())
+		handleScimError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+	loggerWithField(r).Infof("SCIM group patched: %s", group.DisplayName)
+}
+
+// grant or revoke the role of a group according to the difference between its current and its patched members
+func applyGroupMembers(ctx context.Context, group ScimGroup, patched ScimGroup) error {
+	roles, err := GetAllRoles(ctx)
+	if err != nil {
+		return err
+	}
+	roleUrl := roles[group.DisplayName]
+	for _, member := range group.Members {
+		if containsMember(patched.Members, member) {
+			continue
+		}
+		user, err := findScimUser(ctx, member.Value)
+		if err != nil {
+			return err
+		}
+		changed, err := RevokeUserRole(ctx, userHref(user), group.DisplayName, roleUrl)
+		if err != nil {
+			return err
+		}
+		if changed {
+			logrus.Infof("role %s is revoked from user %s", group.DisplayName, user.Name)
+		}
+	}
+	for _, member := range patched.Members {
+		if containsMember(group.Members, member) {
+			continue
+		}
+		user, err := findScimUser(ctx, member.Value)
+		if err != nil {
+			return invalidValueError("%s", err.Error())
+		}
+		changed, err := GrantUserRole(ctx, userHref(user), group.DisplayName, roleUrl)
+		if err != nil {
+			return err
+		}
+		if changed {
+			logrus.Infof("role %s is granted to user %s", group.DisplayName, user.Name)
+		}
+	}
+	return nil
+}
+
+// load all SMC roles as SCIM groups, sorted by name. members are loaded only if withMembers is true
+func loadScimGroups(ctx context.Context, withMembers bool) ([]ScimGroup, error) {
+	roleNames, err := GetRoleNames(ctx)
+	if err != nil {
+		return nil, err
+	}
+	members := make(map[string][]ScimMultiValue)
+	if withMembers {
+		users, err := SmcUsers(ctx, "")
+		if err != nil {
+			return nil, err
+		}
+		usersInfo, err := SmcUsersWithDetails(ctx, users)
+		if err != nil {
+			return nil, err
+		}
+		for _, u := range usersInfo {
+			id := scimUserId(u)
+			for _, p := range u.Permissions["permission"] {
+				members[p.RoleRef] = append(members[p.RoleRef], ScimMultiValue{
+					Value:   id,
+					Ref:     connectorUrl(scimUsersPath + "/" + id),
+					Display: u.Name,
+				})
+			}
+		}
+	}
+	var groups []ScimGroup
+	for roleUrl, name := range roleNames {
+		groups = append(groups, toScimGroup(name, roleUrl, members[roleUrl]))
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		return groups[i].DisplayName < groups[j].DisplayName
+	})
+	return groups, nil
+}
+
+// find a SMC role by its SCIM id or name
+func findScimGroup(ctx context.Context, id string, withMembers bool) (ScimGroup, error) {
+	groups, err := loadScimGroups(ctx, withMembers)
+	if err != nil {
+		return ScimGroup{}, err
+	}
+	for _, group := range groups {
+		if group.Id == id || group.DisplayName == id {
+			return group, nil
+		}
+	}
+	return ScimGroup{}, notFoundError("the given group id: %s not found", id)
+}
+
+func containsMember(members []ScimMultiValue, member ScimMultiValue) bool {
+	for _, m := range members {
+		if strings.EqualFold(m.Value, member.Value) {
+			return true
+		}
+	}
+	return false
+}
+
+// check if the SCIM client asked to leave out the members of groups
+func membersExcluded(r *http.Request) bool {
+	for _, attribute := range strings.Split(r.URL.Query().Get("excludedAttributes"), ",") {
+		if strings.EqualFold(strings.TrimSpace(attribute), "members") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,144 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/spf13/viper"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// the names of the groups of a SCIM list response, each with its members
+func scimGroupNames(t *testing.T, body []byte) string {
+	var response struct {
+		Resources []ScimGroup
+	}
+	if err := json.Unmarshal(body, &response); err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, group := range response.Resources {
+		name := group.DisplayName
+		for _, member := range group.Members {
+			name += " " + member.Display
+		}
+		names = append(names, name)
+	}
+	return strings.Join(names, ",")
+}
+
+func TestScimGetGroups(t *testing.T) {
+	f := newFakeSmc(t)
+	defer f.Close()
+	f.addAdmin("alice", true)
+	f.updateAdmin("alice", func(admin map[string]interface{}) {
+		admin["permissions"] = map[string]interface{}{"permission": []interface{}{map[string]interface{}{
+			"granted_domain_ref": f.url("/elements/admin_domain/1"),
+			"granted_elements":   []interface{}{f.url("/elements/access_control_list/1")},
+			"role_ref":           f.url("/elements/role/2"),
+		}}}
+	})
+
+	tests := []struct {
+		query  string
+		groups string
+	}{
+		{"", "Editor alice,Operator,Owner,Superuser,Viewer"},
+		{"?excludedAttributes=members", "Editor,Operator,Owner,Superuser,Viewer"},
+		{"?filter=" + url.QueryEscape(`displayName eq "editor"`), "Editor alice"},
+		{"?filter=" + url.QueryEscape(`members[value eq "id-alice"]`) + "&excludedAttributes=members", "Editor"},
+		{"?filter=" + url.QueryEscape(`displayName sw "O"`) + "&startIndex=2&count=1", "Owner"},
+	}
+	for _, test := range tests {
+		response := serveConnector(http.MethodGet, scimGroupsPath+test.query, "")
+		if response.Code != http.StatusOK {
+			t.Errorf("%s: got status %d: %s", test.query, response.Code, response.Body.String())
+			continue
+		}
+		if got := scimGroupNames(t, response.Body.Bytes()); got != test.groups {
+			t.Errorf("%s: got the groups %q, want %q", test.query, got, test.groups)
+		}
+	}
+
+	response := serveConnector(http.MethodGet, scimGroupsPath+"/2", "")
+	var group ScimGroup
+	if err := json.Unmarshal(response.Body.Bytes(), &group); err != nil {
+		t.Fatal(err)
+	}
+	if response.Code != http.StatusOK || group.DisplayName != "Editor" || len(group.Members) != 1 ||
+		group.Members[0].Value != "id-alice" {
+		t.Errorf("got status %d and the group %+v", response.Code, group)
+	}
+	if response := serveConnector(http.MethodGet, scimGroupsPath+"/9", ""); response.Code != http.StatusNotFound {
+		t.Errorf("got status %d for an unknown group, want 404", response.Code)
+	}
+	response = serveConnector(http.MethodGet, scimGroupsPath+"?filter="+url.QueryEscape(`displayName eq`), "")
+	if response.Code != http.StatusBadRequest {
+		t.Errorf("got status %d for an invalid filter, want 400", response.Code)
+	}
+}
+
+func TestScimPatchGroupMembers(t *testing.T) {
+	f := newFakeSmc(t)
+	defer f.Close()
+	f.addAdmin("alice", true)
+	viper.Set("ROLE_MAPPING", []interface{}{map[string]interface{}{"GROUP": "Branch Editors",
+		"ROLES": []interface{}{"Editor"}, "DOMAINS": []interface{}{"Branch Domain"},
+		"GRANTED_ELEMENTS": []interface{}{"ALL Firewalls"}}})
+	patch := func(operation string) {
+		response := serveConnector(http.MethodPatch, scimGroupsPath+"/2", `{
+			"schemas": ["urn:ietf:params:scim:api:messages:2.0:PatchOp"],
+			"Operations": [`+operation+`]}`)
+		if response.Code != http.StatusNoContent {
+			t.Fatalf("%s: got status %d: %s", operation, response.Code, response.Body.String())
+		}
+	}
+	permissions := func() []interface{} {
+		return f.admin("alice")["permissions"].(map[string]interface{})["permission"].([]interface{})
+	}
+
+	patch(`{"op": "Add", "path": "members", "value": [{"value": "id-alice"}]}`)
+	granted := permissions()
+	if len(granted) != 1 {
+		t.Fatalf("got the permissions %v, want the Editor role", granted)
+	}
+	// the role is granted in the domain and on the access control list of its role mapping
+	permission := granted[0].(map[string]interface{})
+	if permission["role_ref"] != f.url("/elements/role/2") ||
+		permission["granted_domain_ref"] != f.url("/elements/admin_domain/2") ||
+		permission["granted_elements"].([]interface{})[0] != f.url("/elements/access_control_list/2") {
+		t.Errorf("got the permission %v, want Editor in Branch Domain on ALL Firewalls", permission)
+	}
+	// applying the role mappings finds the same permissions and leaves the admin unchanged
+	puts := f.count(http.MethodPut, "/elements/admin_user/1")
+	source := &fakeIdentitySource{groups: map[string][]IdentityGroup{"alice": {{Name: "Branch Editors"}}}}
+	mappings, err := LoadRoleMappings()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ApplyRoles(context.Background(), source, mappings); err != nil {
+		t.Fatal(err)
+	}
+	if count := f.count(http.MethodPut, "/elements/admin_user/1"); count != puts {
+		t.Errorf("the role mappings rewrote the role granted through /Groups")
+	}
+	// adding an existing member changes nothing
+	patch(`{"op": "add", "path": "members", "value": [{"value": "id-alice"}]}`)
+	if count := f.count(http.MethodPut, "/elements/admin_user/1"); count != puts {
+		t.Errorf("got %d writes of the admin for an existing member", count-puts)
+	}
+
+	patch(`{"op": "Remove", "path": "members[value eq \"id-alice\"]"}`)
+	if revoked := permissions(); len(revoked) != 0 {
+		t.Errorf("got the permissions %v, want none", revoked)
+	}
+
+	response := serveConnector(http.MethodPatch, scimGroupsPath+"/2", `{
+		"schemas": ["urn:ietf:params:scim:api:messages:2.0:PatchOp"],
+		"Operations": [{"op": "add", "path": "members", "value": [{"value": "id-nobody"}]}]}`)
+	if response.Code != http.StatusBadRequest {
+		t.Errorf("got status %d for an unknown member, want 400", response.Code)
+	}
+}
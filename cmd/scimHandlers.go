@@ -0,0 +1,431 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.cicd.cloud.fpdev.io/BD/fp-smc-golang/src/smc"
+	"github.cicd.cloud.fpdev.io/BD/scim-smc-connector/lib"
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// list the SMC admins as SCIM User resources, one page at a time
+func ScimGetUsers(w http.ResponseWriter, r *http.Request) {
+	var filter scimFilter
+	lookupName := ""
+	if query := r.URL.Query().Get("filter"); query != "" {
+		var err error
+		filter, err = parseScimFilter(query)
+		if err != nil {
+			loggerWithField(r).Error(err.Error())
+			handleScimError(w, r, err)
+			return
+		}
+		if name, ok := filterUserName(filter); ok {
+			// the admin found by its name is the only match of the filter
+			lookupName = name
+			filter = nil
+		} else {
+			normalizeUserNameFilter(filter)
+		}
+	}
+	startIndex, count, err := scimPagination(r)
+	if err != nil {
+		loggerWithField(r).Error(err.Error())
+		handleScimError(w, r, err)
+		return
+	}
+	roleNames, err := GetRoleNames(r.Context())
+	if err != nil {
+		loggerWithField(r).Error(err.Error())
+		handleScimError(w, r, err)
+		return
+	}
+	var match func(UserInfo) (bool, error)
+	if filter != nil {
+		match = func(u UserInfo) (bool, error) {
+			resource, err := resourceMap(toScimUser(u, roleNames))
+			if err != nil {
+				return false, err
+			}
+			return matchScimUser(filter, resource), nil
+		}
+	}
+	users, err := SmcUsersByName(r.Context(), lookupName)
+	if err != nil {
+		loggerWithField(r).Error(err.Error())
+		handleScimError(w, r, err)
+		return
+	}
+	usersInfo, total, err := pageSmcUsers(r.Context(), users, match, startIndex, count)
+	if err != nil {
+		loggerWithField(r).Error(err.Error())
+		handleScimError(w, r, err)
+		return
+	}
+	resources := []ScimUser{}
+	for _, u := range usersInfo {
+		resources = append(resources, toScimUser(u, roleNames))
+	}
+	writeScimResponse(w, r, http.StatusOK, scimListResponse(total, startIndex, resources, len(resources)))
+	loggerWithField(r).Info("Get SCIM users")
+}
+
+// get a single SMC admin as a SCIM User resource
+func ScimGetUser(w http.ResponseWriter, r *http.Request) {
+	user, err := findScimUser(r.Context(), mux.Vars(r)["id"])
+	if err != nil {
+		loggerWithField(r).Error(err.Error())
+		handleScimError(w, r, err)
+		return
+	}
+	writeScimUser(w, r, http.StatusOK, user)
+	loggerWithField(r).Infof("Get SCIM user: %s", user.Name)
+}
+
+// create a SMC admin from a SCIM User resource
+func ScimCreateUser(w http.ResponseWriter, r *http.Request) {
+	scimUser := ScimUser{Active: true}
+	if err := json.NewDecoder(r.Body).Decode(&scimUser); err != nil {
+		loggerWithField(r).Error(err.Error())
+		handleScimError(w, r, invalidSyntaxError("%s", err.Error()))
+		return
+	}
+	userName := scimUser.UserName
+	if strings.Contains(userName, "@") {
+		name, err := lib.ExtractName(userName)
+		if err != nil {
+			loggerWithField(r).Error(err.Error())
+			handleScimError(w, r, invalidValueError("%s", err.Error()))
+			return
+		}
+		userName = name
+	}
+	if userName == "" {
+		handleScimError(w, r, invalidValueError("the attribute userName is required"))
+		return
+	}
+	if _, err := CreateUser(r.Context(), userName, scimUser.Active); err != nil {
+		loggerWithField(r).Error(err.Error())
+		handleScimError(w, r, err)
+		return
+	}
+	user, err := findScimUser(r.Context(), userName)
+	if err != nil {
+		loggerWithField(r).Error(err.Error())
+		handleScimError(w, r, err)
+		return
+	}
+	writeScimUser(w, r, http.StatusCreated, user)
+	loggerWithField(r).Infof("SCIM user created: %s", userName)
+}
+
+// replace a SMC admin with the given SCIM User resource. attributes which are not given keep their value
+func ScimReplaceUser(w http.ResponseWriter, r *http.Request) {
+	user, err := findCurrentScimUser(r.Context(), mux.Vars(r)["id"])
+	if err != nil {
+		loggerWithField(r).Error(err.Error())
+		handleScimError(w, r, err)
+		return
+	}
+	roleNames, err := GetRoleNames(r.Context())
+	if err != nil {
+		loggerWithField(r).Error(err.Error())
+		handleScimError(w, r, err)
+		return
+	}
+	current := toScimUser(user, roleNames)
+	replacement := current
+	replacement.Roles = nil
+	replacement.DisplayName = ""
+	if err := json.NewDecoder(r.Body).Decode(&replacement); err != nil {
+		loggerWithField(r).Error(err.Error())
+		handleScimError(w, r, invalidSyntaxError("%s", err.Error()))
+		return
+	}
+	if replacement.Roles == nil {
+		replacement.Roles = current.Roles
+	}
+	if replacement.DisplayName == "" {
+		replacement.DisplayName = current.DisplayName
+	}
+	if err := applyScimUser(r.Context(), user, current, replacement); err != nil {
+		loggerWithField(r).Error(err.Error())
+		handleScimError(w, r, err)
+		return
+	}
+	user, err = GetUserSMCInfo(r.Context(), userHref(user))
+	if err != nil {
+		loggerWithField(r).Error(err.Error())
+		handleScimError(w, r, err)
+		return
+	}
+	writeScimUser(w, r, http.StatusOK, user)
+	loggerWithField(r).Infof("SCIM user replaced: %s", user.Name)
+}
+
+// apply SCIM PATCH operations on a SMC admin
+func ScimPatchUser(w http.ResponseWriter, r *http.Request) {
+	var patch ScimPatchRequest
+	if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+		loggerWithField(r).Error(err.Error())
+		handleScimError(w, r, invalidSyntaxError("%s", err.Error()))
+		return
+	}
+	user, err := findCurrentScimUser(r.Context(), mux.Vars(r)["id"])
+	if err != nil {
+		loggerWithField(r).Error(err.Error())
+		handleScimError(w, r, err)
+		return
+	}
+	user, err = patchSmcUser(r.Context(), user, patch.Operations)
+	if err != nil {
+		loggerWithField(r).Error(err.Error())
+		handleScimError(w, r, err)
+		return
+	}
+	writeScimUser(w, r, http.StatusOK, user)
+	loggerWithField(r).Infof("SCIM user patched: %s", user.Name)
+}
+
+// delete a SMC admin
+func ScimDeleteUser(w http.ResponseWriter, r *http.Request) {
+	user, err := findScimUser(r.Context(), mux.Vars(r)["id"])
+	if err != nil {
+		loggerWithField(r).Error(err.Error())
+		handleScimError(w, r, err)
+		return
+	}
+	if err := DeleteSmcUser(r.Context(), user.Name); err != nil {
+		loggerWithField(r).Error(err.Error())
+		handleScimError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+	loggerWithField(r).Infof("SCIM user deleted: %s", user.Name)
+}
+
+// find a SMC admin by its SCIM id or name
+func findScimUser(ctx context.Context, id string) (UserInfo, error) {
+	var user UserInfo
+	users, err := SmcUsers(ctx, id)
+	if err != nil {
+		return user, err
+	}
+	if len(users) == 0 {
+		return user, notFoundError("the given user id: %s not found", id)
+	}
+	usersInfo, err := SmcUsersWithDetails(ctx, users)
+	if err != nil {
+		return user, err
+	}
+	if len(usersInfo) == 0 {
+		return user, notFoundError("the given user id: %s not found", id)
+	}
+	return usersInfo[0], nil
+}
+
+// find a SMC admin by its SCIM id or name and load its current state from SMC, so that the changes to the admin are
+// not decided on the copy in the user index
+func findCurrentScimUser(ctx context.Context, id string) (UserInfo, error) {
+	user, err := findScimUser(ctx, id)
+	if err != nil {
+		return user, err
+	}
+	return ReloadUserSMCInfo(ctx, userHref(user))
+}
+
+// load one page of the given SMC admins matching the match function (all admins if match is nil), sorted by name.
+// the total number of matching admins is returned with the page. without match function only the admins of the page
+// are loaded with their details
+func pageSmcUsers(ctx context.Context, users []map[string]string, match func(UserInfo) (bool, error), startIndex int,
+	count int) ([]UserInfo, int, error) {
+	sort.Slice(users, func(i, j int) bool {
+		return users[i]["name"] < users[j]["name"]
+	})
+	if match == nil {
+		from, to := pageBounds(len(users), startIndex, count)
+		usersInfo, err := SmcUsersWithDetails(ctx, users[from:to])
+		return usersInfo, len(users), err
+	}
+	usersInfo, err := SmcUsersWithDetails(ctx, users)
+	if err != nil {
+		return nil, 0, err
+	}
+	var matched []UserInfo
+	for _, u := range usersInfo {
+		ok, err := match(u)
+		if err != nil {
+			return nil, 0, err
+		}
+		if ok {
+			matched = append(matched, u)
+		}
+	}
+	from, to := pageBounds(len(matched), startIndex, count)
+	return matched[from:to], len(matched), nil
+}
+
+// apply PATCH operations on a SMC admin and return the updated admin
+func patchSmcUser(ctx context.Context, user UserInfo, operations []Operation) (UserInfo, error) {
+	roleNames, err := GetRoleNames(ctx)
+	if err != nil {
+		return user, err
+	}
+	current := toScimUser(user, roleNames)
+	var patched ScimUser
+	if err := patchScimResource(current, scimUserAttributes, operations, &patched); err != nil {
+		return user, err
+	}
+	if err := applyScimUser(ctx, user, current, patched); err != nil {
+		return user, err
+	}
+	return GetUserSMCInfo(ctx, userHref(user))
+}
+
+// write the changes between two versions of a SCIM user to the SMC admin. userName is mapped to the admin name,
+// displayName to the admin comment and roles to the admin permissions, the admin is only renamed when its userName
+// changes. emails and name are accepted and ignored: the SMC admin element has no attribute to store them and the
+// comment already holds displayName. emails used to rename the admin to their local part, which renamed it whenever
+// an identity provider sent a secondary or changed email while its userName stayed the same
+func applyScimUser(ctx context.Context, user UserInfo, current ScimUser, updated ScimUser) error {
+	if updated.Active != current.Active {
+		if err := setScimUserActive(ctx, &user, updated.Active); err != nil {
+			return err
+		}
+	}
+	name := updated.UserName
+	if strings.Contains(name, "@") {
+		var err error
+		if name, err = lib.ExtractName(name); err != nil {
+			return invalidValueError("%s", err.Error())
+		}
+	}
+	if name == "" {
+		return invalidValueError("the attribute userName cannot be empty")
+	}
+	var roles []string
+	for _, role := range updated.Roles {
+		roles = append(roles, role.Value)
+	}
+	rolesChanged := !sameMultiValues(current.Roles, updated.Roles)
+	if name == user.Name && updated.DisplayName == current.DisplayName && !rolesChanged {
+		return nil
+	}
+	_, err := UpdateSmcUser(ctx, userHref(user), func(instance *smc.Smc, userData *smc.UserData) (bool, error) {
+		userData.Name = name
+		if updated.DisplayName != current.DisplayName {
+			userData.Comment = updated.DisplayName
+		}
+		if !rolesChanged {
+			return true, nil
+		}
+		smcRoles, err := GetRoles(instance)
+		if err != nil {
+			return false, err
+		}
+		if err := setUserRoles(instance, userData, roles, smcRoles); err != nil {
+			return false, err
+		}
+		return true, nil
+	})
+	return err
+}
+
+// set the enabled state of the given admin and keep the local copy in sync
+func setScimUserActive(ctx context.Context, user *UserInfo, active bool) error {
+	changed, err := SetUserActive(ctx, userHref(*user), active)
+	if err != nil {
+		return err
+	}
+	if changed {
+		logrus.Infof("user %s is been set to active=%t", user.Name, active)
+	}
+	user.Enable = active
+	return nil
+}
+
+func sameMultiValues(a []ScimMultiValue, b []ScimMultiValue) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for _, v := range a {
+		found := false
+		for _, w := range b {
+			if strings.EqualFold(v.Value, w.Value) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// read a boolean SCIM value. Azure AD sends booleans as strings ("True", "False")
+func boolValue(value interface{}) (bool, error) {
+	switch v := value.(type) {
+	case bool:
+		return v, nil
+	case string:
+		b, err := strconv.ParseBool(strings.ToLower(v))
+		if err != nil {
+			return false, fmt.Errorf("the value %q is not a boolean", v)
+		}
+		return b, nil
+	}
+	return false, errors.New("the given value is not a boolean")
+}
+
+// write an admin as a SCIM User resource
+func writeScimUser(w http.ResponseWriter, r *http.Request, status int, user UserInfo) {
+	roleNames, err := GetRoleNames(r.Context())
+	if err != nil {
+		loggerWithField(r).Error(err.Error())
+		handleScimError(w, r, err)
+		return
+	}
+	writeScimResponse(w, r, status, toScimUser(user, roleNames))
+}
+
+func writeScimResponse(w http.ResponseWriter, r *http.Request, status int, body interface{}) {
+	w.Header().Set("Content-Type", scimContentType)
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		loggerWithField(r).Error(err.Error())
+	}
+}
+
+func writeScimError(w http.ResponseWriter, r *http.Request, status int, scimType string, detail string) {
+	writeScimResponse(w, r, status, ScimErrorResponse{
+		Schemas:  []string{scimErrorSchema},
+		Status:   strconv.Itoa(status),
+		ScimType: scimType,
+		Detail:   detail,
+	})
+}
+
+// write an error to the SCIM client as a SCIM error response, errors which are not SCIM errors are reported as
+// internal errors
+func handleScimError(w http.ResponseWriter, r *http.Request, err error) {
+	switch e := err.(type) {
+	case *scimError:
+		if e.retryAfter > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(e.retryAfter.Seconds()))))
+		}
+		writeScimError(w, r, e.status, e.scimType, e.detail)
+	case *scimFilterError:
+		writeScimError(w, r, http.StatusBadRequest, "invalidFilter", e.Error())
+	default:
+		writeScimError(w, r, http.StatusInternalServerError, "", err.Error())
+	}
+}
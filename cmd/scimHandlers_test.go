@@ -0,0 +1,309 @@
+package cmd
+
+import (
+	"encoding/json"
+	"github.com/spf13/viper"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestScimPatchUserIgnoresEmails(t *testing.T) {
+	f := newFakeSmc(t)
+	defer f.Close()
+	f.addAdmin("alice", true)
+
+	for _, operation := range []string{
+		`{"op": "replace", "path": "emails[type eq \"work\"].value", "value": "alice.smith@contoso.com"}`,
+		`{"op": "replace", "path": "userName", "value": "alice@contoso.com"}`,
+	} {
+		response := serveConnector(http.MethodPatch, scimUsersPath+"/id-alice", `{
+			"schemas": ["urn:ietf:params:scim:api:messages:2.0:PatchOp"],
+			"Operations": [`+operation+`]}`)
+		if response.Code != http.StatusOK {
+			t.Fatalf("%s: got status %d: %s", operation, response.Code, response.Body.String())
+		}
+	}
+	if f.admin("alice") == nil {
+		t.Error("the admin alice has been renamed")
+	}
+	if puts := f.count(http.MethodPut, "/elements/admin_user/1"); puts != 0 {
+		t.Errorf("got %d writes of the admin, want none", puts)
+	}
+}
+
+func TestScimPatchUserRenamesOnUserName(t *testing.T) {
+	f := newFakeSmc(t)
+	defer f.Close()
+	f.addAdmin("alice", true)
+
+	response := serveConnector(http.MethodPatch, scimUsersPath+"/id-alice", `{
+		"schemas": ["urn:ietf:params:scim:api:messages:2.0:PatchOp"],
+		"Operations": [{"op": "replace", "path": "userName", "value": "alice.smith@contoso.com"}]}`)
+	if response.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", response.Code, response.Body.String())
+	}
+	if f.admin("alice.smith") == nil {
+		t.Error("the admin alice has not been renamed to alice.smith")
+	}
+}
+
+func TestScimPatchUserActiveConverges(t *testing.T) {
+	f := newFakeSmc(t)
+	defer f.Close()
+	f.addAdmin("alice", true)
+
+	for i := 0; i < 3; i++ {
+		response := serveConnector(http.MethodPatch, scimUsersPath+"/id-alice", `{
+			"schemas": ["urn:ietf:params:scim:api:messages:2.0:PatchOp"],
+			"Operations": [{"op": "replace", "path": "active", "value": false}]}`)
+		if response.Code != http.StatusOK {
+			t.Fatalf("PATCH %d: got status %d: %s", i+1, response.Code, response.Body.String())
+		}
+		if enabled := f.admin("alice")["enabled"]; enabled != false {
+			t.Errorf("PATCH %d: the admin is enabled=%v, want false", i+1, enabled)
+		}
+	}
+	if toggles := f.count(http.MethodPut, "/elements/admin_user/1/enable_disable"); toggles != 1 {
+		t.Errorf("got %d toggles, want 1", toggles)
+	}
+}
+
+func TestScimPatchUser(t *testing.T) {
+	f := newFakeSmc(t)
+	defer f.Close()
+	f.addAdmin("alice", true)
+
+	response := serveConnector(http.MethodPatch, scimUsersPath+"/id-alice", `{
+		"schemas": ["urn:ietf:params:scim:api:messages:2.0:PatchOp"],
+		"Operations": [
+			{"op": "Replace", "path": "active", "value": "False"},
+			{"op": "Add", "path": "displayName", "value": "Alice Smith"},
+			{"op": "add", "path": "name.givenName", "value": "Alice"},
+			{"op": "replace", "path": "emails[type eq \"work\"].value", "value": "alice@contoso.com"},
+			{"op": "remove", "path": "externalId"}]}`)
+	if response.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", response.Code, response.Body.String())
+	}
+	var user ScimUser
+	if err := json.Unmarshal(response.Body.Bytes(), &user); err != nil {
+		t.Fatal(err)
+	}
+	if user.UserName != "alice" || user.DisplayName != "Alice Smith" || user.Active {
+		t.Errorf("got the user %+v", user)
+	}
+	admin := f.admin("alice")
+	if admin["enabled"] != false || admin["comment"] != "Alice Smith" {
+		t.Errorf("got the admin %v", admin)
+	}
+}
+
+func TestScimPatchUserInvalidOperations(t *testing.T) {
+	f := newFakeSmc(t)
+	defer f.Close()
+	f.addAdmin("alice", true)
+
+	tests := []struct {
+		operation string
+		scimType  string
+	}{
+		{`{"op": "remove", "path": "active"}`, "mutability"},
+		{`{"op": "Remove", "path": "userName"}`, "mutability"},
+		{`{"op": "replace", "path": "nickName", "value": "al"}`, "invalidPath"},
+		{`{"op": "replace", "path": "emails[type eq \"work\"].country", "value": "FR"}`, "invalidPath"},
+		{`{"op": "replace", "value": {"active": false, "title": "CEO"}}`, "invalidPath"},
+	}
+	for _, test := range tests {
+		response := serveConnector(http.MethodPatch, scimUsersPath+"/id-alice", `{
+			"schemas": ["urn:ietf:params:scim:api:messages:2.0:PatchOp"],
+			"Operations": [`+test.operation+`]}`)
+		var body struct{ ScimType string }
+		json.Unmarshal(response.Body.Bytes(), &body)
+		if response.Code != http.StatusBadRequest || body.ScimType != test.scimType {
+			t.Errorf("%s: got status %d: %s, want %s", test.operation, response.Code, response.Body.String(),
+				test.scimType)
+		}
+	}
+	if puts := f.count(http.MethodPut, "/elements/admin_user/1"); puts != 0 {
+		t.Errorf("got %d writes of the admin, want none", puts)
+	}
+	if toggles := f.count(http.MethodPut, "/elements/admin_user/1/enable_disable"); toggles != 0 {
+		t.Errorf("got %d toggles of the admin, want none", toggles)
+	}
+}
+
+func TestScimUsers(t *testing.T) {
+	f := newFakeSmc(t)
+	defer f.Close()
+	viper.Set("CONNECTOR.PUBLIC_URL", "https://scim.contoso.com/")
+	f.addAdmin("alice", true)
+	f.addLdapUser("bob")
+
+	var user ScimUser
+	decode := func(response *httptest.ResponseRecorder, status int) {
+		t.Helper()
+		if response.Code != status {
+			t.Fatalf("got status %d, want %d: %s", response.Code, status, response.Body.String())
+		}
+		user = ScimUser{}
+		if err := json.Unmarshal(response.Body.Bytes(), &user); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	decode(serveConnector(http.MethodPost, scimUsersPath, `{
+		"schemas": ["urn:ietf:params:scim:schemas:core:2.0:User"],
+		"userName": "bob@contoso.com", "active": false}`), http.StatusCreated)
+	if user.Id != "id-bob" || user.UserName != "bob" || user.Active {
+		t.Errorf("POST: got the user %+v", user)
+	}
+	if want := "https://scim.contoso.com" + scimUsersPath + "/id-bob"; user.Meta == nil || user.Meta.Location != want {
+		t.Errorf("POST: got the meta %+v, want the location %s", user.Meta, want)
+	}
+	if admin := f.admin("bob"); admin == nil || admin["enabled"] != false {
+		t.Errorf("POST: got the admin %v", admin)
+	}
+	response := serveConnector(http.MethodPost, scimUsersPath, `{"userName": "carol@contoso.com"}`)
+	if response.Code != http.StatusNotFound || f.admin("carol") != nil {
+		t.Errorf("POST of a user missing from LDAP: got status %d: %s", response.Code, response.Body.String())
+	}
+
+	decode(serveConnector(http.MethodGet, scimUsersPath+"/id-alice", ""), http.StatusOK)
+	if user.Id != "id-alice" || user.UserName != "alice" || !user.Active {
+		t.Errorf("GET: got the user %+v", user)
+	}
+	response = serveConnector(http.MethodGet, scimUsersPath+"?startIndex=1&count=10", "")
+	var list struct {
+		TotalResults int
+		Resources    []ScimUser
+	}
+	if err := json.Unmarshal(response.Body.Bytes(), &list); err != nil {
+		t.Fatal(err)
+	}
+	if response.Code != http.StatusOK || list.TotalResults != 2 || len(list.Resources) != 2 {
+		t.Errorf("GET list: got status %d: %s", response.Code, response.Body.String())
+	}
+
+	decode(serveConnector(http.MethodPut, scimUsersPath+"/id-alice", `{
+		"schemas": ["urn:ietf:params:scim:schemas:core:2.0:User"],
+		"userName": "alice", "displayName": "Alice Smith", "active": false}`), http.StatusOK)
+	if user.Id != "id-alice" || user.DisplayName != "Alice Smith" || user.Active {
+		t.Errorf("PUT: got the user %+v", user)
+	}
+	if admin := f.admin("alice"); admin["enabled"] != false || admin["comment"] != "Alice Smith" {
+		t.Errorf("PUT: got the admin %v", admin)
+	}
+
+	response = serveConnector(http.MethodDelete, scimUsersPath+"/id-alice", "")
+	if response.Code != http.StatusNoContent || f.admin("alice") != nil {
+		t.Errorf("DELETE: got status %d: %s", response.Code, response.Body.String())
+	}
+	for _, method := range []string{http.MethodGet, http.MethodDelete} {
+		if response := serveConnector(method, scimUsersPath+"/id-alice", ""); response.Code != http.StatusNotFound {
+			t.Errorf("%s of a deleted user: got status %d: %s", method, response.Code, response.Body.String())
+		}
+	}
+}
+
+func TestScimHandlersWhenSmcFails(t *testing.T) {
+	tests := []struct {
+		name string
+		fail func(f *fakeSmc)
+		// the circuit breaker opens while SMC keeps failing
+		statuses []int
+	}{
+		{"down", func(f *fakeSmc) { f.server.Close() }, []int{http.StatusServiceUnavailable}},
+		{"failing", func(f *fakeSmc) {
+			f.setFailure(func(r *http.Request) int {
+				if strings.Contains(r.URL.Path, "/elements/") {
+					return http.StatusInternalServerError
+				}
+				return 0
+			})
+		}, []int{http.StatusBadGateway, http.StatusServiceUnavailable}},
+	}
+	for _, test := range tests {
+		f := newFakeSmc(t)
+		f.addAdmin("alice", true)
+		test.fail(f)
+		for _, request := range []struct{ method, target, body string }{
+			{http.MethodGet, scimUsersPath, ""},
+			{http.MethodGet, scimUsersPath + "/id-alice", ""},
+			{http.MethodPost, scimUsersPath, `{"userName": "bob@contoso.com"}`},
+			{http.MethodPatch, scimUsersPath + "/id-alice", `{"Operations": [{"op": "replace", "path": "active", "value": false}]}`},
+			{http.MethodDelete, scimUsersPath + "/id-alice", ""},
+		} {
+			response := serveConnector(request.method, request.target, request.body)
+			if !intInSlice(response.Code, test.statuses) {
+				t.Errorf("SMC %s: %s %s: got status %d, want %v: %s", test.name, request.method, request.target,
+					response.Code, test.statuses, response.Body.String())
+			}
+		}
+		f.Close()
+	}
+}
+
+func intInSlice(value int, list []int) bool {
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func TestScimGetUsersFilter(t *testing.T) {
+	f := newFakeSmc(t)
+	defer f.Close()
+	f.addAdmin("alice", true)
+	f.addAdmin("bob", false)
+
+	tests := []struct {
+		filter string
+		status int
+		users  string
+	}{
+		{`userName eq "ALICE"`, http.StatusOK, "alice"},
+		{`userName eq "Alice@contoso.com"`, http.StatusOK, "alice"},
+		// the LDAP unique ID of alice is not her user name
+		{`userName eq "id-alice"`, http.StatusOK, ""},
+		{`userName eq "carol"`, http.StatusOK, ""},
+		{`active eq false`, http.StatusOK, "bob"},
+		{`userName sw "A" or userName ew "OB"`, http.StatusOK, "alice,bob"},
+		{`userName gt "alice"`, http.StatusOK, "bob"},
+		{`userName eq "alice" and active eq false`, http.StatusOK, ""},
+		{`userName eq`, http.StatusBadRequest, ""},
+		{`userName xx "alice"`, http.StatusBadRequest, ""},
+		{`(userName eq "alice"`, http.StatusBadRequest, ""},
+	}
+	for _, test := range tests {
+		response := serveConnector(http.MethodGet, scimUsersPath+"?filter="+url.QueryEscape(test.filter), "")
+		if response.Code != test.status {
+			t.Errorf("%s: got status %d, want %d: %s", test.filter, response.Code, test.status,
+				response.Body.String())
+			continue
+		}
+		var body struct {
+			ScimType  string
+			Resources []struct{ UserName string }
+		}
+		if err := json.Unmarshal(response.Body.Bytes(), &body); err != nil {
+			t.Fatal(err)
+		}
+		if test.status != http.StatusOK {
+			if body.ScimType != "invalidFilter" {
+				t.Errorf("%s: got the scimType %q, want invalidFilter", test.filter, body.ScimType)
+			}
+			continue
+		}
+		var names []string
+		for _, resource := range body.Resources {
+			names = append(names, resource.UserName)
+		}
+		if got := strings.Join(names, ","); got != test.users {
+			t.Errorf("%s: got the users %q, want %q", test.filter, got, test.users)
+		}
+	}
+}
@@ -0,0 +1,343 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// the target of a PATCH operation: attribute[filter].subAttribute (RFC 7644 section 3.5.2)
+type patchPath struct {
+	attribute    string
+	filter       scimFilter
+	subAttribute string
+}
+
+// attributes the SCIM client is not allowed to modify
+var readOnlyAttributes = []string{"id", "meta", "schemas"}
+
+// the attributes common to all resources which are not declared in the schema of a resource (RFC 7643 section 3.1).
+// externalId is accepted and ignored
+var commonAttributes = []string{"id", "externalId", "meta", "schemas"}
+
+// parse the path of a PATCH operation, the attribute must be declared in the given attributes of the resource
+func parsePatchPath(path string, attributes []ScimAttribute) (*patchPath, error) {
+	p := &patchPath{}
+	if open := strings.Index(path, "["); open != -1 {
+		closing := strings.LastIndex(path, "]")
+		if closing < open {
+			return nil, invalidPathError("invalid path %q", path)
+		}
+		filter, err := parseScimFilter(path[open+1 : closing])
+		if err != nil {
+			return nil, invalidPathError("%s", err.Error())
+		}
+		p.attribute = normalizeAttributePath(path[:open])
+		p.filter = filter
+		rest := path[closing+1:]
+		if rest != "" {
+			if !strings.HasPrefix(rest, ".") || len(rest) == 1 {
+				return nil, invalidPathError("invalid path %q", path)
+			}
+			p.subAttribute = rest[1:]
+		}
+	} else {
+		parts := strings.SplitN(normalizeAttributePath(path), ".", 2)
+		p.attribute = parts[0]
+		if len(parts) == 2 {
+			p.subAttribute = parts[1]
+		}
+	}
+	if p.attribute == "" {
+		return nil, invalidPathError("invalid path %q", path)
+	}
+	for _, a := range readOnlyAttributes {
+		if strings.EqualFold(a, p.attribute) {
+			return nil, mutabilityError("the attribute %s is read only", p.attribute)
+		}
+	}
+	for _, a := range commonAttributes {
+		if strings.EqualFold(a, p.attribute) {
+			return p, nil
+		}
+	}
+	definition, ok := findScimAttribute(attributes, p.attribute)
+	if !ok {
+		return nil, invalidPathError("unknown attribute %s in the path %q", p.attribute, path)
+	}
+	if p.subAttribute != "" {
+		if _, ok := findScimAttribute(definition.SubAttributes, p.subAttribute); !ok {
+			return nil, invalidPathError("unknown sub-attribute %s of %s in the path %q", p.subAttribute,
+				definition.Name, path)
+		}
+	}
+	return p, nil
+}
+
+// find the definition of an attribute by its name, attribute names are case insensitive
+func findScimAttribute(attributes []ScimAttribute, name string) (ScimAttribute, bool) {
+	for _, a := range attributes {
+		if strings.EqualFold(a.Name, name) {
+			return a, true
+		}
+	}
+	return ScimAttribute{}, false
+}
+
+// apply a single PATCH operation on a resource decoded to a map, whose schema declares the given attributes. operation
+// names are case insensitive
+func applyPatchOperation(resource map[string]interface{}, attributes []ScimAttribute, op Operation) error {
+	switch strings.ToLower(op.Op) {
+	case "add", "replace":
+		add := strings.EqualFold(op.Op, "add")
+		if op.Path == "" {
+			values, ok := op.Value.(map[string]interface{})
+			if !ok {
+				return invalidValueError("an operation without path requires an object value")
+			}
+			for k, v := range values {
+				if err := applyPatchOperation(resource, attributes, Operation{Op: op.Op, Path: k, Value: v}); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		p, err := parsePatchPath(op.Path, attributes)
+		if err != nil {
+			return err
+		}
+		return p.set(resource, op.Value, add)
+	case "remove":
+		if op.Path == "" {
+			return noTargetError("the remove operation requires a path")
+		}
+		p, err := parsePatchPath(op.Path, attributes)
+		if err != nil {
+			return err
+		}
+		// a required attribute cannot be unset, nor a boolean such as active: a SMC admin is enabled or disabled
+		if definition, ok := findScimAttribute(attributes, p.attribute); ok && p.filter == nil &&
+			p.subAttribute == "" && (definition.Required || definition.Type == "boolean") {
+			return mutabilityError("the attribute %s cannot be removed", definition.Name)
+		}
+		p.remove(resource, op.Value)
+		return nil
+	}
+	return invalidSyntaxError("unsupported operation %q", op.Op)
+}
+
+func (p *patchPath) set(resource map[string]interface{}, value interface{}, add bool) error {
+	key := attributeKey(resource, p.attribute)
+	current := resource[key]
+	if p.filter == nil {
+		if p.subAttribute == "" {
+			existing, isList := current.([]interface{})
+			switch {
+			case add && isList:
+				resource[key] = appendValues(existing, value)
+			case add && isMap(current) && isMap(value):
+				for k, v := range value.(map[string]interface{}) {
+					current.(map[string]interface{})[attributeKey(current.(map[string]interface{}), k)] = v
+				}
+			default:
+				resource[key] = value
+			}
+			return nil
+		}
+		if list, ok := current.([]interface{}); ok {
+			for _, element := range list {
+				if m, ok := element.(map[string]interface{}); ok {
+					m[attributeKey(m, p.subAttribute)] = value
+				}
+			}
+			return nil
+		}
+		m, ok := current.(map[string]interface{})
+		if !ok {
+			m = make(map[string]interface{})
+			resource[key] = m
+		}
+		m[attributeKey(m, p.subAttribute)] = value
+		return nil
+	}
+	list, _ := current.([]interface{})
+	matched := false
+	for i, element := range list {
+		m, ok := element.(map[string]interface{})
+		if !ok || !p.filter.matches(m) {
+			continue
+		}
+		matched = true
+		if p.subAttribute != "" {
+			m[attributeKey(m, p.subAttribute)] = value
+		} else {
+			list[i] = value
+		}
+	}
+	if matched {
+		return nil
+	}
+	// a filter of equality terms describes the value to create, e.g. emails[type eq "work"].value
+	element, ok := filterTemplate(p.filter)
+	if !ok || p.subAttribute == "" {
+		return noTargetError("no value of %s matches the filter", p.attribute)
+	}
+	element[p.subAttribute] = value
+	resource[key] = append(list, element)
+	return nil
+}
+
+func (p *patchPath) remove(resource map[string]interface{}, value interface{}) {
+	key := attributeKey(resource, p.attribute)
+	current, ok := resource[key]
+	if !ok {
+		return
+	}
+	list, isList := current.([]interface{})
+	if p.filter == nil {
+		switch {
+		case p.subAttribute != "" && isList:
+			for _, element := range list {
+				if m, ok := element.(map[string]interface{}); ok {
+					delete(m, attributeKey(m, p.subAttribute))
+				}
+			}
+		case p.subAttribute != "":
+			if m, ok := current.(map[string]interface{}); ok {
+				delete(m, attributeKey(m, p.subAttribute))
+			}
+		case isList && value != nil:
+			// remove the given values only, as sent by Azure AD for members and roles
+			resource[key] = removeValues(list, value)
+		default:
+			delete(resource, key)
+		}
+		return
+	}
+	var remaining []interface{}
+	for _, element := range list {
+		m, ok := element.(map[string]interface{})
+		if !ok || !p.filter.matches(m) {
+			remaining = append(remaining, element)
+			continue
+		}
+		if p.subAttribute != "" {
+			delete(m, attributeKey(m, p.subAttribute))
+			remaining = append(remaining, m)
+		}
+	}
+	resource[key] = remaining
+}
+
+// find the key of an attribute in a resource, attribute names are case insensitive
+func attributeKey(resource map[string]interface{}, name string) string {
+	for k := range resource {
+		if strings.EqualFold(k, name) {
+			return k
+		}
+	}
+	return name
+}
+
+func isMap(value interface{}) bool {
+	_, ok := value.(map[string]interface{})
+	return ok
+}
+
+// append values to a multi-valued attribute, values which already exist are not duplicated
+func appendValues(list []interface{}, value interface{}) []interface{} {
+	for _, v := range flattenValue(value) {
+		if indexOfValue(list, v) == -1 {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+func removeValues(list []interface{}, value interface{}) []interface{} {
+	for _, v := range flattenValue(value) {
+		if i := indexOfValue(list, v); i != -1 {
+			list = append(list[:i], list[i+1:]...)
+		}
+	}
+	return list
+}
+
+// find a value in a multi-valued attribute. complex values are compared by their "value" sub-attribute
+func indexOfValue(list []interface{}, value interface{}) int {
+	key := multiValueKey(value)
+	for i, v := range list {
+		if multiValueKey(v) == key {
+			return i
+		}
+	}
+	return -1
+}
+
+func multiValueKey(value interface{}) string {
+	if m, ok := value.(map[string]interface{}); ok {
+		if v, ok := lookupAttribute(m, "value"); ok {
+			value = v
+		}
+	}
+	return strings.ToLower(fmt.Sprint(value))
+}
+
+// build the value described by a filter made of equality terms joined by "and"
+func filterTemplate(filter scimFilter) (map[string]interface{}, bool) {
+	switch f := filter.(type) {
+	case *attributeExpression:
+		if f.operator != "eq" || strings.Contains(f.path, ".") {
+			return nil, false
+		}
+		return map[string]interface{}{f.path: f.value}, true
+	case *logicalExpression:
+		if f.operator != "and" {
+			return nil, false
+		}
+		left, ok := filterTemplate(f.left)
+		if !ok {
+			return nil, false
+		}
+		right, ok := filterTemplate(f.right)
+		if !ok {
+			return nil, false
+		}
+		for k, v := range right {
+			left[k] = v
+		}
+		return left, true
+	}
+	return nil, false
+}
+
+// apply PATCH operations on a SCIM resource, whose schema declares the given attributes, and decode the result into
+// patched
+func patchScimResource(resource interface{}, attributes []ScimAttribute, operations []Operation,
+	patched interface{}) error {
+	m, err := resourceMap(resource)
+	if err != nil {
+		return err
+	}
+	for _, op := range operations {
+		if err := applyPatchOperation(m, attributes, op); err != nil {
+			return err
+		}
+	}
+	// Azure AD sends booleans as strings
+	if key := attributeKey(m, "active"); m[key] != nil {
+		active, err := boolValue(m[key])
+		if err != nil {
+			return invalidValueError("%s", err.Error())
+		}
+		m[key] = active
+	}
+	buff, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(buff, patched); err != nil {
+		return invalidValueError("%s", err.Error())
+	}
+	return nil
+}
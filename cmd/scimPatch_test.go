@@ -0,0 +1,115 @@
+package cmd
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestApplyPatchOperation(t *testing.T) {
+	tests := []struct {
+		name string
+		op   Operation
+		want string
+	}{
+		{"replace a simple attribute", Operation{Op: "replace", Path: "displayName", Value: "Alice Smith"},
+			`{"active":true,"displayName":"Alice Smith","emails":[{"type":"work","value":"alice@contoso.com"}],` +
+				`"roles":[{"value":"Viewer"}],"userName":"alice"}`},
+		{"op names ignore the case", Operation{Op: "Replace", Path: "active", Value: false},
+			`{"active":false,"displayName":"Alice","emails":[{"type":"work","value":"alice@contoso.com"}],` +
+				`"roles":[{"value":"Viewer"}],"userName":"alice"}`},
+		{"attribute names ignore the case", Operation{Op: "REPLACE", Path: "DisplayName", Value: "Alice Smith"},
+			`{"active":true,"displayName":"Alice Smith","emails":[{"type":"work","value":"alice@contoso.com"}],` +
+				`"roles":[{"value":"Viewer"}],"userName":"alice"}`},
+		{"replace without path", Operation{Op: "replace", Value: map[string]interface{}{"active": false,
+			"displayName": "Alice Smith"}},
+			`{"active":false,"displayName":"Alice Smith","emails":[{"type":"work","value":"alice@contoso.com"}],` +
+				`"roles":[{"value":"Viewer"}],"userName":"alice"}`},
+		{"add to a multi-valued attribute", Operation{Op: "Add", Path: "roles",
+			Value: []interface{}{map[string]interface{}{"value": "Editor"}, map[string]interface{}{"value": "viewer"}}},
+			`{"active":true,"displayName":"Alice","emails":[{"type":"work","value":"alice@contoso.com"}],` +
+				`"roles":[{"value":"Viewer"},{"value":"Editor"}],"userName":"alice"}`},
+		{"replace a multi-valued attribute", Operation{Op: "replace", Path: "roles",
+			Value: []interface{}{map[string]interface{}{"value": "Editor"}}},
+			`{"active":true,"displayName":"Alice","emails":[{"type":"work","value":"alice@contoso.com"}],` +
+				`"roles":[{"value":"Editor"}],"userName":"alice"}`},
+		{"replace through a value path", Operation{Op: "replace", Path: `emails[type eq "work"].value`,
+			Value: "alice.smith@contoso.com"},
+			`{"active":true,"displayName":"Alice","emails":[{"type":"work","value":"alice.smith@contoso.com"}],` +
+				`"roles":[{"value":"Viewer"}],"userName":"alice"}`},
+		{"add a value described by a value path", Operation{Op: "add", Path: `emails[type eq "home"].value`,
+			Value: "alice@example.org"},
+			`{"active":true,"displayName":"Alice","emails":[{"type":"work","value":"alice@contoso.com"},` +
+				`{"type":"home","value":"alice@example.org"}],"roles":[{"value":"Viewer"}],"userName":"alice"}`},
+		{"remove through a value path", Operation{Op: "remove", Path: `emails[type eq "work"]`},
+			`{"active":true,"displayName":"Alice","emails":null,"roles":[{"value":"Viewer"}],"userName":"alice"}`},
+		{"remove the given values", Operation{Op: "Remove", Path: "roles",
+			Value: []interface{}{map[string]interface{}{"value": "viewer"}}},
+			`{"active":true,"displayName":"Alice","emails":[{"type":"work","value":"alice@contoso.com"}],` +
+				`"roles":[],"userName":"alice"}`},
+		{"remove an attribute", Operation{Op: "remove", Path: "displayName"},
+			`{"active":true,"emails":[{"type":"work","value":"alice@contoso.com"}],"roles":[{"value":"Viewer"}],` +
+				`"userName":"alice"}`},
+		{"externalId is accepted", Operation{Op: "add", Path: "externalId", Value: "1234"},
+			`{"active":true,"displayName":"Alice","emails":[{"type":"work","value":"alice@contoso.com"}],` +
+				`"externalId":"1234","roles":[{"value":"Viewer"}],"userName":"alice"}`},
+		{"schema URNs are stripped", Operation{Op: "replace",
+			Path: "urn:ietf:params:scim:schemas:core:2.0:User:name.givenName", Value: "Alice"},
+			`{"active":true,"displayName":"Alice","emails":[{"type":"work","value":"alice@contoso.com"}],` +
+				`"name":{"givenName":"Alice"},"roles":[{"value":"Viewer"}],"userName":"alice"}`},
+	}
+	for _, test := range tests {
+		resource := map[string]interface{}{
+			"userName":    "alice",
+			"displayName": "Alice",
+			"active":      true,
+			"emails":      []interface{}{map[string]interface{}{"type": "work", "value": "alice@contoso.com"}},
+			"roles":       []interface{}{map[string]interface{}{"value": "Viewer"}},
+		}
+		if err := applyPatchOperation(resource, scimUserAttributes, test.op); err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		buff, err := json.Marshal(resource)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(buff) != test.want {
+			t.Errorf("%s: got %s, want %s", test.name, buff, test.want)
+		}
+	}
+}
+
+func TestApplyInvalidPatchOperation(t *testing.T) {
+	tests := []struct {
+		op       Operation
+		scimType string
+	}{
+		{Operation{Op: "remove", Path: "active"}, "mutability"},
+		{Operation{Op: "Remove", Path: "userName"}, "mutability"},
+		{Operation{Op: "replace", Path: "id", Value: "bob"}, "mutability"},
+		{Operation{Op: "replace", Path: "meta.version", Value: "1"}, "mutability"},
+		{Operation{Op: "replace", Value: map[string]interface{}{"id": "bob"}}, "mutability"},
+		{Operation{Op: "replace", Path: "nickName", Value: "al"}, "invalidPath"},
+		{Operation{Op: "add", Path: "urn:ietf:params:scim:schemas:extension:enterprise:2.0:User:department",
+			Value: "IT"}, "invalidPath"},
+		{Operation{Op: "replace", Path: "emails.country", Value: "FR"}, "invalidPath"},
+		{Operation{Op: "replace", Path: `emails[type eq "work"].country`, Value: "FR"}, "invalidPath"},
+		{Operation{Op: "replace", Path: "userName.value", Value: "bob"}, "invalidPath"},
+		{Operation{Op: "replace", Value: map[string]interface{}{"title": "CEO"}}, "invalidPath"},
+		{Operation{Op: "remove", Path: "nickName"}, "invalidPath"},
+		{Operation{Op: "replace", Path: `emails[type eq "work"`, Value: "x"}, "invalidPath"},
+		{Operation{Op: "replace", Path: `emails[type xx "work"].value`, Value: "x"}, "invalidPath"},
+		{Operation{Op: "replace", Path: `emails[type eq "home"]`, Value: "x"}, "noTarget"},
+		{Operation{Op: "remove"}, "noTarget"},
+		{Operation{Op: "replace", Value: "alice"}, "invalidValue"},
+		{Operation{Op: "move", Path: "userName"}, "invalidSyntax"},
+	}
+	for _, test := range tests {
+		resource := map[string]interface{}{"userName": "alice", "active": true,
+			"emails": []interface{}{map[string]interface{}{"type": "work", "value": "alice@contoso.com"}}}
+		err := applyPatchOperation(resource, scimUserAttributes, test.op)
+		if e, ok := err.(*scimError); !ok || e.status != 400 || e.scimType != test.scimType {
+			t.Errorf("%+v: got %#v, want a %s error", test.op, err, test.scimType)
+		}
+	}
+}
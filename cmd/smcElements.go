@@ -0,0 +1,120 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.cicd.cloud.fpdev.io/BD/fp-smc-golang/src/smc"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// the SMC element types the permissions of the admins are made of, named as their SMC entry points
+const (
+	smcRoleElement              = "role"
+	smcAdminDomainElement       = "admin_domain"
+	smcAccessControlListElement = "access_control_list"
+)
+
+// the hrefs of a cached element type are loaded again after this period
+const smcElementsCacheTime = 10 * time.Minute
+
+// the hrefs of SMC elements by their name, looked up through the entry points of SMC. the elements rarely change, so
+// each type is cached. a type is loaded again when its cache is expired, when a name is missing from it or after the
+// cache is invalidated
+type smcElementCache struct {
+	mu       sync.Mutex
+	hrefs    map[string]map[string]string
+	loadedAt map[string]time.Time
+}
+
+var smcElements = newSmcElementCache()
+
+func newSmcElementCache() *smcElementCache {
+	return &smcElementCache{hrefs: make(map[string]map[string]string), loadedAt: make(map[string]time.Time)}
+}
+
+// the hrefs of all elements of a type by their name
+func (c *smcElementCache) Hrefs(instance *smc.Smc, elementType string) (map[string]string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	hrefs, err := c.load(instance, elementType, false)
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[string]string, len(hrefs))
+	for name, href := range hrefs {
+		result[name] = href
+	}
+	return result, nil
+}
+
+// the href of an element, empty if no element of the type has this name
+func (c *smcElementCache) Href(instance *smc.Smc, elementType string, name string) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	hrefs, err := c.load(instance, elementType, false)
+	if err != nil {
+		return "", err
+	}
+	if href, ok := hrefs[name]; ok {
+		return href, nil
+	}
+	// the element may have been created since the type was loaded
+	hrefs, err = c.load(instance, elementType, true)
+	if err != nil {
+		return "", err
+	}
+	return hrefs[name], nil
+}
+
+// drop all cached hrefs, called when the elements of SMC may have changed
+func (c *smcElementCache) Invalidate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.hrefs = make(map[string]map[string]string)
+	c.loadedAt = make(map[string]time.Time)
+}
+
+func (c *smcElementCache) load(instance *smc.Smc, elementType string, reload bool) (map[string]string, error) {
+	if hrefs, ok := c.hrefs[elementType]; ok && !reload && time.Since(c.loadedAt[elementType]) < smcElementsCacheTime {
+		return hrefs, nil
+	}
+	hrefs, err := getElementHrefs(instance, elementType)
+	if err != nil {
+		return nil, err
+	}
+	c.hrefs[elementType] = hrefs
+	c.loadedAt[elementType] = time.Now()
+	return hrefs, nil
+}
+
+// load the hrefs of all SMC elements of a type by their name from the entry point of the type
+func getElementHrefs(instance *smc.Smc, elementType string) (map[string]string, error) {
+	entryPoint, ok := instance.EntryPoints[elementType]
+	if !ok {
+		return nil, fmt.Errorf("SMC offers no entry point for the elements of type %s", elementType)
+	}
+	response, err := checkSmcResponse(instance.GetHttp(entryPoint))
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, smcStatusError(response.StatusCode, "failed in loading the SMC elements of type %s", elementType)
+	}
+	buff, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+	elements := make(map[string][]map[string]string)
+	if err := json.Unmarshal(buff, &elements); err != nil {
+		return nil, err
+	}
+	hrefs := make(map[string]string)
+	for _, element := range elements["result"] {
+		hrefs[element["name"]] = element["href"]
+	}
+	return hrefs, nil
+}
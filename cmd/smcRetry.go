@@ -0,0 +1,227 @@
+package cmd
+
+import (
+	"expvar"
+	"fmt"
+	"github.cicd.cloud.fpdev.io/BD/scim-smc-connector/lib"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the metrics of the requests to SMC, served with the other expvar variables by the Metrics route
+var (
+	smcRequestsRetried  = expvar.NewInt("smc_requests_retried")
+	smcRequestsRejected = expvar.NewInt("smc_requests_rejected")
+	smcCircuitOpened    = expvar.NewInt("smc_circuit_opened")
+)
+
+func init() {
+	expvar.Publish("smc_circuit_state", expvar.Func(func() interface{} {
+		return smcBreaker.State()
+	}))
+}
+
+// the retry policy of the requests to SMC. the reads failing with a connection error or a 5xx response are retried
+// with a jittered exponential backoff, other responses are returned as they are
+type smcRetryPolicy struct {
+	attempts  int
+	baseDelay time.Duration
+	maxDelay  time.Duration
+}
+
+func newSmcRetryPolicyFromConfig() *smcRetryPolicy {
+	return &smcRetryPolicy{
+		attempts:  viper.GetInt("SMC.RETRY_ATTEMPTS"),
+		baseDelay: time.Duration(viper.GetInt("SMC.RETRY_BASE_DELAY_IN_MILLISECONDS")) * time.Millisecond,
+		maxDelay:  time.Duration(viper.GetInt("SMC.RETRY_MAX_DELAY_IN_SECONDS")) * time.Second,
+	}
+}
+
+// the delay before the given retry, a random duration up to the exponential backoff of the retry
+func (p *smcRetryPolicy) delay(retry int) time.Duration {
+	backoff := p.maxDelay
+	if retry < 30 && p.baseDelay<<uint(retry) < p.maxDelay {
+		backoff = p.baseDelay << uint(retry)
+	}
+	if backoff <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(backoff) + 1))
+}
+
+// send a request, retrying it while it fails transiently. only requests which can be sent again are retried: the
+// reads and the login, whose body can be read again
+func (p *smcRetryPolicy) roundTrip(next http.RoundTripper, request *http.Request) (*http.Response, error) {
+	retryable := isSafe(request.Method) || strings.HasSuffix(request.URL.Path, "/login")
+	if request.Body != nil && request.Body != http.NoBody && request.GetBody == nil {
+		retryable = false
+	}
+	for retry := 0; ; retry++ {
+		response, err := next.RoundTrip(request)
+		if !retryable || retry >= p.attempts || !isTransientSmcFailure(response, err) ||
+			request.Context().Err() != nil {
+			return response, err
+		}
+		if response != nil {
+			io.Copy(ioutil.Discard, response.Body)
+			response.Body.Close()
+		}
+		delay := p.delay(retry)
+		logrus.Debugf("retrying %s %s in %s", request.Method, request.URL.Path, delay)
+		smcRequestsRetried.Add(1)
+		if err := lib.SleepContext(request.Context(), delay); err != nil {
+			return nil, err
+		}
+		if request.GetBody != nil {
+			body, err := request.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			request = request.Clone(request.Context())
+			request.Body = body
+		}
+	}
+}
+
+// the writes are not retried as SMC may have applied a write whose response was lost: a PUT sent again fails on the
+// ETag it was sent with, a DELETE on the deleted element, and the enable_disable PUT toggles the admin back
+func isSafe(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+	return false
+}
+
+// SMC cannot be reached or failed in handling the request
+func isTransientSmcFailure(response *http.Response, err error) bool {
+	return err != nil || response.StatusCode >= http.StatusInternalServerError
+}
+
+// the circuit breaker of the requests to SMC. after a number of consecutive transient failures the circuit is
+// opened, and the requests fail immediately instead of waiting for SMC. once the cooldown has passed a single request
+// is let through to probe SMC, the circuit is closed again when it succeeds
+type smcCircuitBreaker struct {
+	mu        sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	failures  int
+	open      bool
+	openedAt  time.Time
+	probing   bool
+}
+
+var smcBreaker *smcCircuitBreaker
+
+func newSmcCircuitBreakerFromConfig() *smcCircuitBreaker {
+	return &smcCircuitBreaker{
+		threshold: viper.GetInt("SMC.CIRCUIT_BREAKER_FAILURES"),
+		cooldown:  time.Duration(viper.GetInt("SMC.CIRCUIT_BREAKER_COOLDOWN_IN_SECONDS")) * time.Second,
+	}
+}
+
+// check whether a request may be sent to SMC, the returned duration is the time left until SMC is probed again
+func (b *smcCircuitBreaker) allow() (bool, time.Duration) {
+	if b == nil || b.threshold <= 0 {
+		return true, 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.open {
+		return true, 0
+	}
+	if left := b.cooldown - time.Since(b.openedAt); left > 0 {
+		return false, left
+	}
+	if b.probing {
+		return false, time.Second
+	}
+	b.probing = true
+	return true, 0
+}
+
+// the time left until SMC is probed again, zero when requests are sent to SMC
+func (b *smcCircuitBreaker) RetryAfter() time.Duration {
+	if b == nil {
+		return 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.open {
+		return 0
+	}
+	if left := b.cooldown - time.Since(b.openedAt); left > 0 {
+		return left
+	}
+	if b.probing {
+		return time.Second
+	}
+	return 0
+}
+
+// record the result of a request sent to SMC
+func (b *smcCircuitBreaker) record(failed bool) {
+	if b == nil || b.threshold <= 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !failed {
+		if b.open {
+			logrus.Info("SMC is reachable again, the circuit breaker is closed")
+		}
+		b.failures, b.open, b.probing = 0, false, false
+		return
+	}
+	b.failures++
+	if b.probing || (!b.open && b.failures >= b.threshold) {
+		if !b.open {
+			logrus.Errorf("SMC failed %d times in a row, the requests to SMC are rejected for %s", b.failures,
+				b.cooldown)
+			smcCircuitOpened.Add(1)
+		}
+		b.open, b.openedAt, b.probing = true, time.Now(), false
+	}
+}
+
+// forget a request let through which ended without telling anything about SMC, such as a cancelled request
+func (b *smcCircuitBreaker) release() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+}
+
+// the state of the circuit: closed, open or half-open while SMC is probed
+func (b *smcCircuitBreaker) State() string {
+	if b == nil {
+		return "closed"
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch {
+	case !b.open:
+		return "closed"
+	case b.probing || time.Since(b.openedAt) >= b.cooldown:
+		return "half-open"
+	}
+	return "open"
+}
+
+// returned for the requests to SMC rejected by the open circuit
+type smcCircuitOpenError struct {
+	retryAfter time.Duration
+}
+
+func (e *smcCircuitOpenError) Error() string {
+	return fmt.Sprintf("SMC is not available, retry in %s", e.retryAfter.Round(time.Second))
+}
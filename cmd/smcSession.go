@@ -0,0 +1,161 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"github.cicd.cloud.fpdev.io/BD/fp-smc-golang/src/smc"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// returned by the work done in a session when SMC rejects the session cookie
+var errSmcUnauthorized = errors.New("the SMC session is not valid")
+
+// a single authenticated session with SMC shared by the handlers and the background sync. the session is opened on
+// first use and kept open, the work done in it is serialized as the SMC client is not safe for concurrent use
+type SmcSession struct {
+	// holds a value while work is done in the session, a channel so waiting for the session can be cancelled
+	busy     chan struct{}
+	instance *smc.Smc
+	// the context of the work done in the session, the SMC client does not take contexts so the requests to SMC get
+	// it from the session in the transport
+	ctx context.Context
+}
+
+var smcSession *SmcSession
+
+func NewSmcSession(instance *smc.Smc) *SmcSession {
+	return &SmcSession{busy: make(chan struct{}, 1), instance: instance}
+}
+
+// run the given work in the session. the API version is negotiated with SMC before the first login unless it is
+// configured. when SMC rejects the session, a new session is opened and the work is run again.
+// the work is cancelled with the given context and after SMC.REQUEST_TIMEOUT_IN_SECONDS
+func (s *SmcSession) Do(ctx context.Context, work func(instance *smc.Smc) error) error {
+	// fail fast while SMC is known to be down
+	if retryAfter := smcBreaker.RetryAfter(); retryAfter > 0 {
+		return smcCircuitOpenScimError(retryAfter)
+	}
+	ctx, release, err := s.acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+	for retried := false; ; retried = true {
+		if s.instance.APIVersion == "" {
+			version, err := negotiateSmcApiVersion(ctx, s.instance)
+			if err != nil {
+				return sessionError(ctx, err)
+			}
+			s.instance.APIVersion = version
+		}
+		if err := s.instance.Login(); err != nil {
+			return sessionError(ctx, err)
+		}
+		err := work(s.instance)
+		if err != nil && (ctx.Err() != nil || smcBreaker.RetryAfter() > 0) {
+			return sessionError(ctx, err)
+		}
+		if !isSmcUnauthorized(err) {
+			return smcWorkError(err)
+		}
+		// drop the rejected cookie so the next login opens a new session. SMC may have been upgraded in the meantime, so
+		// the API version is negotiated again
+		s.instance.SetCookie = false
+		if isSmcApiVersionNegotiated() {
+			s.instance.APIVersion = ""
+		}
+		if retried {
+			return smcUnavailableError(err)
+		}
+		logrus.Info("the SMC session is expired, login to SMC again")
+		smcElements.Invalidate()
+		smcUserIndex.Invalidate()
+	}
+}
+
+// open the session, negotiating the API version with SMC unless it is configured
+func (s *SmcSession) Open(ctx context.Context) error {
+	return s.Do(ctx, func(instance *smc.Smc) error {
+		return nil
+	})
+}
+
+// the error reported for work which failed in reaching SMC
+func sessionError(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return smcTimeoutError(err)
+	}
+	if retryAfter := smcBreaker.RetryAfter(); retryAfter > 0 {
+		return smcCircuitOpenScimError(retryAfter)
+	}
+	return smcUnavailableError(err)
+}
+
+// the error reported for work which failed in SMC. errors of the SMC client and unusable responses of SMC are
+// reported as bad gateway
+func smcWorkError(err error) error {
+	if _, ok := err.(*scimError); ok || err == nil {
+		return err
+	}
+	return smcBadResponseError(err)
+}
+
+// close the session with SMC
+func (s *SmcSession) Close() error {
+	_, release, err := s.acquire(context.Background())
+	if err != nil {
+		return err
+	}
+	defer release()
+	return s.instance.Logout()
+}
+
+// wait for the session and limit the work to SMC.REQUEST_TIMEOUT_IN_SECONDS. the returned function releases the session
+func (s *SmcSession) acquire(ctx context.Context) (context.Context, func(), error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(viper.GetInt("SMC.REQUEST_TIMEOUT_IN_SECONDS"))*time.Second)
+	select {
+	case s.busy <- struct{}{}:
+	case <-ctx.Done():
+		cancel()
+		return nil, nil, smcTimeoutError(errors.New("the SMC session is busy"))
+	}
+	s.ctx = ctx
+	return ctx, func() {
+		s.ctx = nil
+		<-s.busy
+		cancel()
+	}, nil
+}
+
+// the context of the work done in the session, requests sent to SMC outside of the session are not cancelled
+func (s *SmcSession) context() context.Context {
+	if s == nil || s.ctx == nil {
+		return context.Background()
+	}
+	return s.ctx
+}
+
+// check a response of SMC, a rejected session is reported as errSmcUnauthorized. the body of a checked response must
+// be closed by the caller
+func checkSmcResponse(response *http.Response, err error) (*http.Response, error) {
+	if err != nil {
+		return nil, err
+	}
+	if response == nil {
+		return nil, errors.New("got an empty response from SMC")
+	}
+	if response.StatusCode == http.StatusUnauthorized {
+		response.Body.Close()
+		return nil, errSmcUnauthorized
+	}
+	return response, nil
+}
+
+// the SMC client reports the status of some failed requests in its error messages only
+func isSmcUnauthorized(err error) bool {
+	return err != nil && (errors.Is(err, errSmcUnauthorized) || strings.Contains(err.Error(), "http status: 401"))
+}
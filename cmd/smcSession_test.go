@@ -0,0 +1,88 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.cicd.cloud.fpdev.io/BD/fp-smc-golang/src/smc"
+	"net/http"
+	"sync"
+	"testing"
+)
+
+func TestSmcSessionSerializesConcurrentRequests(t *testing.T) {
+	f := newFakeSmc(t)
+	defer f.Close()
+	var hrefs []string
+	for i := 0; i < 5; i++ {
+		hrefs = append(hrefs, f.addAdmin(fmt.Sprintf("user%d", i), true))
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 40)
+	for i := 0; i < 20; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			if response := serveConnector(http.MethodGet, scimUsersPath, ""); response.Code != http.StatusOK {
+				errs <- fmt.Errorf("listing the users: status %d: %s", response.Code, response.Body.String())
+			}
+		}(i)
+		go func(i int) {
+			defer wg.Done()
+			if _, err := SetUserActive(context.Background(), hrefs[i%len(hrefs)], i%2 == 0); err != nil {
+				errs <- err
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	if logins := f.loginCount(); logins != 1 {
+		t.Errorf("got %d logins, want 1", logins)
+	}
+	if concurrent := f.concurrentRequests(); concurrent != 1 {
+		t.Errorf("SMC got %d concurrent requests, want 1", concurrent)
+	}
+}
+
+func TestSmcSessionLoginAgainWhenExpired(t *testing.T) {
+	f := newFakeSmc(t)
+	defer f.Close()
+	href := f.addAdmin("alice", true)
+
+	if _, err := SetUserActive(context.Background(), href, false); err != nil {
+		t.Fatal(err)
+	}
+	f.expireSession()
+	if _, err := SetUserActive(context.Background(), href, true); err != nil {
+		t.Fatal(err)
+	}
+	if logins := f.loginCount(); logins != 2 {
+		t.Errorf("got %d logins, want 2", logins)
+	}
+	if enabled := f.admin("alice")["enabled"]; enabled != true {
+		t.Errorf("the admin is enabled=%v, want true", enabled)
+	}
+}
+
+func TestUpdateSmcUserDoesNotWriteDeletedAdmin(t *testing.T) {
+	f := newFakeSmc(t)
+	defer f.Close()
+	href := f.addAdmin("alice", true)
+	f.deleteAdmin("alice")
+
+	_, err := UpdateSmcUser(context.Background(), href, func(instance *smc.Smc, userData *smc.UserData) (bool, error) {
+		userData.Comment = "updated"
+		return true, nil
+	})
+	var scimErr *scimError
+	if !errors.As(err, &scimErr) || scimErr.status != http.StatusNotFound {
+		t.Fatalf("got error %v, want a not found error", err)
+	}
+	if puts := f.count(http.MethodPut, "/elements/admin_user/1"); puts != 0 {
+		t.Errorf("got %d writes of the deleted admin, want none", puts)
+	}
+}
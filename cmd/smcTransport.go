@@ -0,0 +1,205 @@
+package cmd
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.cicd.cloud.fpdev.io/BD/fp-smc-golang/src/httpClient"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the SMC client builds all its URLs with http. its requests are sent with the dedicated HTTP client of SMC, whose
+// transport sends them with https when SMC.SCHEME is https and verifies SMC with the configured CA and certificate pin,
+// and cancels them with the work of the SMC session. failed reads are retried and a circuit breaker stops sending
+// requests while SMC is down. the requests to other hosts are passed to the default transport, unless they carry the
+// SMC session cookie
+type smcTransport struct {
+	// host:port of SMC
+	host  string
+	https bool
+	retry *smcRetryPolicy
+	smc   http.RoundTripper
+	next  http.RoundTripper
+
+	mu sync.Mutex
+	// the session cookie of the last login to SMC
+	cookie string
+}
+
+func (t *smcTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	if !strings.EqualFold(requestHost(request), t.host) {
+		// the SMC client sends the session cookie with all its requests, including those to hrefs of another host
+		if t.carriesSessionCookie(request) {
+			return nil, fmt.Errorf("refusing to send the SMC session cookie to %s, which is not SMC.IP_ADDRESS and "+
+				"SMC.PORT", request.URL.Host)
+		}
+		return t.next.RoundTrip(request)
+	}
+	// the SMC client sends its requests without context, they are cancelled with the work done in the SMC session. a
+	// round tripper must not modify the given request
+	request = request.Clone(smcSession.context())
+	if t.https && request.URL.Scheme == "http" {
+		request.URL.Scheme = "https"
+	}
+	if ok, retryAfter := smcBreaker.allow(); !ok {
+		smcRequestsRejected.Add(1)
+		return nil, &smcCircuitOpenError{retryAfter: retryAfter}
+	}
+	response, err := t.retry.roundTrip(t.smc, request)
+	if err != nil && request.Context().Err() != nil {
+		smcBreaker.release()
+	} else {
+		smcBreaker.record(isTransientSmcFailure(response, err))
+	}
+	if err == nil && strings.HasSuffix(request.URL.Path, "/login") {
+		if setCookie := response.Header.Get("Set-Cookie"); setCookie != "" {
+			t.mu.Lock()
+			t.cookie = strings.TrimSpace(strings.Split(setCookie, ";")[0])
+			t.mu.Unlock()
+		}
+	}
+	return response, err
+}
+
+func (t *smcTransport) carriesSessionCookie(request *http.Request) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.cookie == "" {
+		return false
+	}
+	for _, cookie := range request.Header["Cookie"] {
+		if strings.Contains(cookie, t.cookie) {
+			return true
+		}
+	}
+	return false
+}
+
+// the host:port a request is sent to, with the default port of its scheme when the URL has none
+func requestHost(request *http.Request) string {
+	if request.URL.Port() != "" {
+		return request.URL.Host
+	}
+	port := "80"
+	if strings.EqualFold(request.URL.Scheme, "https") {
+		port = "443"
+	}
+	return net.JoinHostPort(request.URL.Hostname(), port)
+}
+
+// the HTTP client of the requests to SMC, set by InstallSmcClient
+var smcHttpClient = &http.Client{}
+
+// send the requests of the SMC client with an HTTP client configured by the SMC section of the config file. the
+// default transport of the process is left untouched
+func InstallSmcClient() error {
+	scheme := strings.ToLower(viper.GetString("SMC.SCHEME"))
+	if scheme != "http" && scheme != "https" {
+		return fmt.Errorf("unsupported SMC.SCHEME %q, it must be http or https", scheme)
+	}
+	transport := &smcTransport{
+		host:  net.JoinHostPort(viper.GetString("SMC.IP_ADDRESS"), viper.GetString("SMC.PORT")),
+		https: scheme == "https",
+		retry: newSmcRetryPolicyFromConfig(),
+		next:  http.DefaultTransport,
+	}
+	smcBreaker = newSmcCircuitBreakerFromConfig()
+	smcRoundTripper := &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		TLSHandshakeTimeout: 10 * time.Second,
+		IdleConnTimeout:     90 * time.Second,
+	}
+	if transport.https {
+		tlsConfig, err := NewSmcTlsConfig()
+		if err != nil {
+			return err
+		}
+		smcRoundTripper.TLSClientConfig = tlsConfig
+	} else {
+		logrus.Warn("SMC.SCHEME is http, the SMC API key and the session cookie are sent in cleartext")
+	}
+	transport.smc = smcRoundTripper
+	smcHttpClient = &http.Client{Transport: transport}
+	httpClient.SetClient(smcHttpClient)
+	return nil
+}
+
+// the TLS config verifying SMC. the certificate of SMC is verified against SMC.CA_FILE, or the system CAs when no CA
+// file is given. with SMC.CERTIFICATE_SHA256 the certificate must also match this SHA-256 fingerprint, a pinned
+// certificate is trusted without CA when no CA file is given
+func NewSmcTlsConfig() (*tls.Config, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	caFile := viper.GetString("SMC.CA_FILE")
+	if caFile != "" {
+		buff, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(buff) {
+			return nil, fmt.Errorf("no certificate found in %s", caFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if pin := viper.GetString("SMC.CERTIFICATE_SHA256"); pin != "" {
+		fingerprint, err := hex.DecodeString(strings.ReplaceAll(pin, ":", ""))
+		if err != nil || len(fingerprint) != sha256.Size {
+			return nil, errors.New("SMC.CERTIFICATE_SHA256 must be the hex encoded SHA-256 fingerprint of the SMC certificate")
+		}
+		// the pin is checked by VerifyPeerCertificate, which also runs the CA verification when a CA file is given
+		tlsConfig.InsecureSkipVerify = true
+		tlsConfig.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return errors.New("SMC presented no certificate")
+			}
+			certificate := sha256.Sum256(rawCerts[0])
+			if !bytes.Equal(certificate[:], fingerprint) {
+				return fmt.Errorf("the certificate of SMC does not match SMC.CERTIFICATE_SHA256, its fingerprint is %s",
+					hex.EncodeToString(certificate[:]))
+			}
+			if caFile == "" {
+				return nil
+			}
+			return verifyCertificateChain(rawCerts, tlsConfig.RootCAs)
+		}
+	}
+	certFile, keyFile := viper.GetString("SMC.CLIENT_CERTIFICATE"), viper.GetString("SMC.CLIENT_KEY")
+	if certFile != "" || keyFile != "" {
+		certificate, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed in loading the SMC client certificate: %s", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{certificate}
+	}
+	return tlsConfig, nil
+}
+
+// verify a certificate chain against the given CAs. the host name is not checked as SMC is usually reached by its IP
+// address, the pinned certificate identifies SMC
+func verifyCertificateChain(rawCerts [][]byte, roots *x509.CertPool) error {
+	var certificates []*x509.Certificate
+	for _, raw := range rawCerts {
+		certificate, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return err
+		}
+		certificates = append(certificates, certificate)
+	}
+	intermediates := x509.NewCertPool()
+	for _, certificate := range certificates[1:] {
+		intermediates.AddCert(certificate)
+	}
+	_, err := certificates[0].Verify(x509.VerifyOptions{Roots: roots, Intermediates: intermediates})
+	return err
+}
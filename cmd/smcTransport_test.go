@@ -0,0 +1,257 @@
+package cmd
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"github.cicd.cloud.fpdev.io/BD/fp-smc-golang/src/smc"
+	"github.com/spf13/viper"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// a certificate issued by a test CA, with its PEM encoded files
+type testCertificate struct {
+	certificate *x509.Certificate
+	key         *ecdsa.PrivateKey
+	certPEM     []byte
+	keyPEM      []byte
+}
+
+func (c *testCertificate) tlsCertificate(t *testing.T) tls.Certificate {
+	certificate, err := tls.X509KeyPair(c.certPEM, c.keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return certificate
+}
+
+// issue a certificate signed by the given CA, a self-signed CA certificate when ca is nil
+func issueTestCertificate(t *testing.T, ca *testCertificate, name string, usage x509.ExtKeyUsage) *testCertificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	parent, parentKey := template, key
+	if ca == nil {
+		template.IsCA, template.BasicConstraintsValid = true, true
+		template.KeyUsage |= x509.KeyUsageCertSign
+		template.ExtKeyUsage = nil
+	} else {
+		parent, parentKey = ca.certificate, ca.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCertificate{
+		certificate: certificate,
+		key:         key,
+		certPEM:     pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:      pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}),
+	}
+}
+
+func writeTestFile(t *testing.T, dir string, name string, content []byte) string {
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, content, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestSmcTransportTls(t *testing.T) {
+	dir, err := ioutil.TempDir("", "smc-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ca := issueTestCertificate(t, nil, "SMC test CA", 0)
+	otherCa := issueTestCertificate(t, nil, "other CA", 0)
+	serverCert := issueTestCertificate(t, ca, "smc", x509.ExtKeyUsageServerAuth)
+	clientCert := issueTestCertificate(t, ca, "connector", x509.ExtKeyUsageClientAuth)
+	caFile := writeTestFile(t, dir, "ca.pem", ca.certPEM)
+	otherCaFile := writeTestFile(t, dir, "other-ca.pem", otherCa.certPEM)
+	clientCertFile := writeTestFile(t, dir, "client.pem", clientCert.certPEM)
+	clientKeyFile := writeTestFile(t, dir, "client.key", clientCert.keyPEM)
+	fingerprint := sha256.Sum256(serverCert.certificate.Raw)
+	pin := hex.EncodeToString(fingerprint[:])
+
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca.certificate)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	server.TLS = &tls.Config{
+		Certificates: []tls.Certificate{serverCert.tlsCertificate(t)},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+	}
+	server.StartTLS()
+	defer server.Close()
+	host, port, err := net.SplitHostPort(server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		config map[string]string
+		ok     bool
+	}{
+		{"CA file", map[string]string{"SMC.CA_FILE": caFile}, true},
+		{"pin without CA file", map[string]string{"SMC.CERTIFICATE_SHA256": pin}, true},
+		{"pin and CA file", map[string]string{"SMC.CA_FILE": caFile, "SMC.CERTIFICATE_SHA256": pin}, true},
+		{"system CAs", map[string]string{}, false},
+		{"other CA", map[string]string{"SMC.CA_FILE": otherCaFile}, false},
+		{"wrong pin", map[string]string{"SMC.CA_FILE": caFile, "SMC.CERTIFICATE_SHA256": strings.Repeat("00", 32)},
+			false},
+		{"pin and other CA", map[string]string{"SMC.CA_FILE": otherCaFile, "SMC.CERTIFICATE_SHA256": pin}, false},
+		{"no client certificate", map[string]string{"SMC.CA_FILE": caFile, "SMC.CLIENT_CERTIFICATE": "",
+			"SMC.CLIENT_KEY": ""}, false},
+	}
+	for _, test := range tests {
+		viper.Reset()
+		setConfigDefaults()
+		viper.Set("SMC.IP_ADDRESS", host)
+		viper.Set("SMC.PORT", port)
+		viper.Set("SMC.SCHEME", "https")
+		viper.Set("SMC.RETRY_ATTEMPTS", 0)
+		viper.Set("SMC.CLIENT_CERTIFICATE", clientCertFile)
+		viper.Set("SMC.CLIENT_KEY", clientKeyFile)
+		for key, value := range test.config {
+			viper.Set(key, value)
+		}
+		if err := InstallSmcClient(); err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		// the SMC client sends its requests with http, they are sent to SMC with https
+		response, err := smcHttpClient.Get("http://" + net.JoinHostPort(host, port) + "/6.7/api")
+		if err == nil {
+			response.Body.Close()
+		}
+		if (err == nil) != test.ok {
+			t.Errorf("%s: got error %v, want ok=%t", test.name, err, test.ok)
+		}
+	}
+}
+
+func TestSmcClientLeavesDefaultTransport(t *testing.T) {
+	transport := http.DefaultTransport
+	f := newFakeSmc(t)
+	defer f.Close()
+
+	if http.DefaultTransport != transport {
+		t.Error("the default transport has been replaced")
+	}
+	if _, err := SmcUsers(context.Background(), ""); err != nil {
+		t.Fatal(err)
+	}
+	if logins := f.loginCount(); logins != 1 {
+		t.Errorf("got %d logins to SMC, want 1", logins)
+	}
+}
+
+func TestSmcTransportKeepsSessionCookie(t *testing.T) {
+	f := newFakeSmc(t)
+	defer f.Close()
+	var cookies []string
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cookies = append(cookies, r.Header.Get("Cookie"))
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer other.Close()
+
+	var response *http.Response
+	err := smcSession.Do(context.Background(), func(instance *smc.Smc) error {
+		// an href of SMC given with another host
+		var err error
+		response, err = instance.GetHttp(other.URL + "/6.7/elements/admin_user")
+		return err
+	})
+	if err == nil {
+		response.Body.Close()
+		t.Error("the request carrying the SMC session cookie has been sent to another host")
+	}
+	if len(cookies) != 0 {
+		t.Errorf("another host received the cookies %v", cookies)
+	}
+	// requests without the cookie are sent
+	response, err = smcHttpClient.Get(other.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+}
+
+func TestSmcTransportRetriesOnlyReads(t *testing.T) {
+	f := newFakeSmc(t)
+	defer f.Close()
+	viper.Set("SMC.CIRCUIT_BREAKER_FAILURES", 0)
+	if err := InstallSmcClient(); err != nil {
+		t.Fatal(err)
+	}
+	f.setFailure(func(r *http.Request) int {
+		return http.StatusBadGateway
+	})
+
+	tests := []struct {
+		method string
+		path   string
+		sent   int
+	}{
+		{http.MethodGet, "/elements/admin_user/1", viper.GetInt("SMC.RETRY_ATTEMPTS") + 1},
+		{http.MethodPost, "/login", viper.GetInt("SMC.RETRY_ATTEMPTS") + 1},
+		// SMC may have applied the write whose response was lost
+		{http.MethodPut, "/elements/admin_user/1", 1},
+		{http.MethodPut, "/elements/admin_user/1/enable_disable", 1},
+		{http.MethodDelete, "/elements/admin_user/1", 1},
+		{http.MethodPost, "/elements/admin_user", 1},
+	}
+	for _, test := range tests {
+		request, err := http.NewRequest(test.method, f.url(test.path), strings.NewReader("{}"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		response, err := smcHttpClient.Do(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response.Body.Close()
+		if sent := f.count(test.method, test.path); sent != test.sent {
+			t.Errorf("%s %s: sent %d times, want %d", test.method, test.path, sent, test.sent)
+		}
+	}
+}
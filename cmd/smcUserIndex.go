@@ -0,0 +1,272 @@
+package cmd
+
+import (
+	"errors"
+	"github.cicd.cloud.fpdev.io/BD/fp-smc-golang/src/smc"
+	"github.cicd.cloud.fpdev.io/BD/fp-smc-golang/src/utils"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// an index of the SMC admins and of the users of the LDAP domain of SMC, so the users are looked up without loading
+// all admins or browsing the LDAP domain for each lookup. the index is loaded again after
+// SMC.USER_CACHE_TIME_IN_SECONDS, the admins are dropped from it when the connector changes them
+type smcUserCache struct {
+	mu sync.Mutex
+	// the admins as listed by SMC, with their name and href
+	admins []map[string]string
+	// the admins by their lowercased name, SMC admin names are not case sensitive
+	adminsByName map[string]map[string]string
+	// the admins by their href
+	adminsByHref map[string]map[string]string
+	// the admins by the unique ID of their LDAP user, the last part of its href. an admin is indexed once its details
+	// are loaded
+	adminsByLdapId map[string]map[string]string
+	// the details of the admins by their href
+	details        map[string]UserInfo
+	adminsLoadedAt time.Time
+	// the hrefs of the users of the LDAP search bases seen so far by their name
+	ldapUsers         map[string]string
+	ldapUsersLoadedAt time.Time
+}
+
+var smcUserIndex = newSmcUserCache()
+
+func newSmcUserCache() *smcUserCache {
+	return &smcUserCache{details: make(map[string]UserInfo)}
+}
+
+func smcUserCacheTime() time.Duration {
+	return time.Duration(viper.GetInt("SMC.USER_CACHE_TIME_IN_SECONDS")) * time.Second
+}
+
+// all admins, each with its name and href
+func (c *smcUserCache) Admins(instance *smc.Smc) ([]map[string]string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.loadAdmins(instance); err != nil {
+		return nil, err
+	}
+	admins := make([]map[string]string, 0, len(c.admins))
+	for _, admin := range c.admins {
+		admins = append(admins, copyAdmin(admin))
+	}
+	return admins, nil
+}
+
+// the admin with the given name, ignoring the case. nil if there is no such admin
+func (c *smcUserCache) Admin(instance *smc.Smc, name string) (map[string]string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.loadAdmins(instance); err != nil {
+		return nil, err
+	}
+	if admin, ok := c.adminsByName[strings.ToLower(name)]; ok {
+		return copyAdmin(admin), nil
+	}
+	return nil, nil
+}
+
+// the admin whose LDAP user has the given unique ID. nil if there is no such admin. an admin is named after its LDAP
+// user, so when the LDAP user has been seen in the LDAP domain only the details of the admin of the same name are
+// loaded. otherwise the details of the admins not indexed yet are loaded until the admin is found
+func (c *smcUserCache) AdminByLdapId(instance *smc.Smc, id string) (map[string]string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.loadAdmins(instance); err != nil {
+		return nil, err
+	}
+	if admin, ok := c.adminsByLdapId[id]; ok {
+		return copyAdmin(admin), nil
+	}
+	for name, href := range c.ldapUsers {
+		if ldapUserId(href) != id {
+			continue
+		}
+		if admin, ok := c.adminsByName[strings.ToLower(name)]; ok {
+			if _, err := c.loadDetails(instance, admin["href"]); err != nil {
+				return nil, err
+			}
+			if admin, ok := c.adminsByLdapId[id]; ok {
+				return copyAdmin(admin), nil
+			}
+		}
+		break
+	}
+	for _, admin := range c.admins {
+		if _, ok := c.details[admin["href"]]; ok {
+			continue
+		}
+		if _, err := c.loadDetails(instance, admin["href"]); err != nil {
+			return nil, err
+		}
+		if admin, ok := c.adminsByLdapId[id]; ok {
+			return copyAdmin(admin), nil
+		}
+	}
+	return nil, nil
+}
+
+// the details of the admin with the given href
+func (c *smcUserCache) Details(instance *smc.Smc, href string) (UserInfo, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.loadAdmins(instance); err != nil {
+		return UserInfo{}, err
+	}
+	return c.loadDetails(instance, href)
+}
+
+// the details of the admin with the given href loaded again from SMC
+func (c *smcUserCache) Reload(instance *smc.Smc, href string) (UserInfo, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.loadAdmins(instance); err != nil {
+		return UserInfo{}, err
+	}
+	delete(c.details, href)
+	return c.loadDetails(instance, href)
+}
+
+// the href of a user of the LDAP search bases, empty if the user is not found. the search bases are browsed until the
+// user is found and the users seen on the way are kept in the index. a missing user is searched again on each lookup,
+// it may have been replicated to the LDAP domain in the meantime
+func (c *smcUserCache) LdapUser(instance *smc.Smc, name string) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.ldapUsers == nil || time.Since(c.ldapUsersLoadedAt) >= smcUserCacheTime() {
+		c.ldapUsers, c.ldapUsersLoadedAt = make(map[string]string), time.Now()
+	}
+	if href, ok := c.ldapUsers[name]; ok {
+		return href, nil
+	}
+	return searchLdapUser(instance, name, c.ldapUsers)
+}
+
+// drop the admin with the given href, called when the connector changes the admin
+func (c *smcUserCache) InvalidateAdmin(href string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.details, href)
+	c.unindexLdapId(href)
+}
+
+// drop all admins, called when the connector creates, renames or deletes an admin
+func (c *smcUserCache) InvalidateAdmins() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.admins = nil
+}
+
+// drop the whole index, called when the users of SMC may have changed
+func (c *smcUserCache) Invalidate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.admins = nil
+	c.ldapUsers = nil
+}
+
+// load the list of the admins when it is missing or expired. the details of the admins expire with the list
+func (c *smcUserCache) loadAdmins(instance *smc.Smc) error {
+	if c.admins != nil && time.Since(c.adminsLoadedAt) < smcUserCacheTime() {
+		return nil
+	}
+	body, err := instance.GetAllAdmins()
+	if err != nil {
+		return err
+	}
+	if body == nil {
+		return errors.New("failed in loading the SMC admins: got an empty response from SMC")
+	}
+	if closer, ok := body.(io.Closer); ok {
+		defer closer.Close()
+	}
+	result, err := utils.ResponseToMap(body)
+	if err != nil {
+		return err
+	}
+	c.admins = result["result"]
+	if c.admins == nil {
+		c.admins = []map[string]string{}
+	}
+	c.adminsByName = make(map[string]map[string]string, len(c.admins))
+	c.adminsByHref = make(map[string]map[string]string, len(c.admins))
+	for _, admin := range c.admins {
+		c.adminsByName[strings.ToLower(admin["name"])] = admin
+		c.adminsByHref[admin["href"]] = admin
+	}
+	c.adminsByLdapId = make(map[string]map[string]string)
+	c.details = make(map[string]UserInfo)
+	c.adminsLoadedAt = time.Now()
+	return nil
+}
+
+func (c *smcUserCache) loadDetails(instance *smc.Smc, href string) (UserInfo, error) {
+	if info, ok := c.details[href]; ok {
+		return info, nil
+	}
+	info, err := getUserSMCInfo(instance, href)
+	if err != nil {
+		return info, err
+	}
+	c.details[href] = info
+	c.unindexLdapId(href)
+	if admin, ok := c.adminsByHref[href]; ok {
+		if id := ldapUserId(info.LdapUser); id != "" {
+			c.adminsByLdapId[id] = admin
+		}
+	}
+	return info, nil
+}
+
+// drop the LDAP user ID of the admin with the given href from the index, its LDAP user may change
+func (c *smcUserCache) unindexLdapId(href string) {
+	for id, admin := range c.adminsByLdapId {
+		if admin["href"] == href {
+			delete(c.adminsByLdapId, id)
+		}
+	}
+}
+
+// the unique ID of an LDAP user, the last part of its href
+func ldapUserId(href string) string {
+	parts := strings.Split(href, "/")
+	return parts[len(parts)-1]
+}
+
+// search a user in the LDAP search bases. each search base is a path of OUs from the root of the domain, such as
+// "Corp/Staff", which is browsed recursively until the user is found. a name found in several search bases is resolved
+// to the first of them. the hrefs of the users seen are added to users by their name
+func searchLdapUser(instance *smc.Smc, name string, users map[string]string) (string, error) {
+	ldapDomain, err := instance.ExternalLdapDomain(viper.GetString("LDAP_DOMAIN"))
+	if err != nil {
+		return "", err
+	}
+	for _, base := range ldapSearchBases() {
+		baseHref, err := browseLdapPath(instance, ldapDomain["href"], base)
+		if err != nil {
+			return "", err
+		}
+		if baseHref == "" {
+			logrus.Warnf("the LDAP search base %s is not found in the domain %s", base, viper.GetString("LDAP_DOMAIN"))
+			continue
+		}
+		href, err := browseLdapUser(instance, baseHref, name, users, make(map[string]bool))
+		if err != nil || href != "" {
+			return href, err
+		}
+	}
+	return "", nil
+}
+
+func copyAdmin(admin map[string]string) map[string]string {
+	result := make(map[string]string, len(admin))
+	for key, value := range admin {
+		result[key] = value
+	}
+	return result
+}
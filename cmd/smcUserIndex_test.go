@@ -0,0 +1,157 @@
+package cmd
+
+import (
+	"context"
+	"github.cicd.cloud.fpdev.io/BD/fp-smc-golang/src/smc"
+	"net/http"
+	"strconv"
+	"testing"
+)
+
+func TestSmcUserIndexRename(t *testing.T) {
+	f := newFakeSmc(t)
+	defer f.Close()
+	href := f.addAdmin("alice", true)
+
+	if users, err := SmcUsers(context.Background(), "alice"); err != nil || len(users) != 1 {
+		t.Fatalf("got %v, %v, want the admin alice", users, err)
+	}
+	_, err := UpdateSmcUser(context.Background(), href, func(instance *smc.Smc, userData *smc.UserData) (bool, error) {
+		userData.Name = "bob"
+		return true, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if users, err := SmcUsers(context.Background(), "bob"); err != nil || len(users) != 1 {
+		t.Errorf("got %v, %v, want the renamed admin bob", users, err)
+	}
+	if users, err := SmcUsers(context.Background(), "alice"); err != nil || len(users) != 0 {
+		t.Errorf("got %v, %v, want no admin alice", users, err)
+	}
+}
+
+func TestSmcUserIndexLdapUser(t *testing.T) {
+	f := newFakeSmc(t)
+	defer f.Close()
+	f.addLdapUser("alice")
+	f.addLdapUser("bob")
+	lookup := func(name string) string {
+		var href string
+		err := smcSession.Do(context.Background(), func(instance *smc.Smc) error {
+			var err error
+			href, err = smcUserIndex.LdapUser(instance, name)
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return href
+	}
+
+	if href := lookup("alice"); href != f.url("/ldap/users/id-alice") {
+		t.Errorf("got %q for alice", href)
+	}
+	browsed := f.count(http.MethodGet, "/ldap/users/browse")
+	// bob has been seen while alice was searched
+	if href := lookup("bob"); href != f.url("/ldap/users/id-bob") {
+		t.Errorf("got %q for bob", href)
+	}
+	if count := f.count(http.MethodGet, "/ldap/users/browse"); count != browsed {
+		t.Errorf("the LDAP domain has been browsed again for a known user")
+	}
+	if href := lookup("carol"); href != "" {
+		t.Errorf("got %q for the missing user carol", href)
+	}
+	// a missing user is searched again
+	f.addLdapUser("carol")
+	if href := lookup("carol"); href != f.url("/ldap/users/id-carol") {
+		t.Errorf("got %q for carol", href)
+	}
+}
+
+func TestScimPatchUserReadsCurrentState(t *testing.T) {
+	f := newFakeSmc(t)
+	defer f.Close()
+	f.addAdmin("alice", true)
+
+	if response := serveConnector(http.MethodGet, scimUsersPath+"/id-alice", ""); response.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", response.Code, response.Body.String())
+	}
+	// the admin is disabled in SMC after it has been indexed
+	f.updateAdmin("alice", func(admin map[string]interface{}) {
+		admin["enabled"] = false
+	})
+	response := serveConnector(http.MethodPatch, scimUsersPath+"/id-alice", `{
+		"schemas": ["urn:ietf:params:scim:api:messages:2.0:PatchOp"],
+		"Operations": [{"op": "replace", "path": "active", "value": true}]}`)
+	if response.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", response.Code, response.Body.String())
+	}
+	if enabled := f.admin("alice")["enabled"]; enabled != true {
+		t.Errorf("the admin is enabled=%v, want true", enabled)
+	}
+}
+
+func TestSmcUserIndexAdminByLdapId(t *testing.T) {
+	f := newFakeSmc(t)
+	defer f.Close()
+	for _, name := range []string{"alice", "bob", "carol", "dave", "erin"} {
+		f.addAdmin(name, true)
+	}
+	detailsLoaded := func() int {
+		loads := 0
+		for key := 1; key <= 5; key++ {
+			loads += f.count(http.MethodGet, "/elements/admin_user/"+strconv.Itoa(key))
+		}
+		return loads
+	}
+	lookup := func(lookup func(instance *smc.Smc) (map[string]string, error)) map[string]string {
+		var admin map[string]string
+		err := smcSession.Do(context.Background(), func(instance *smc.Smc) error {
+			var err error
+			admin, err = lookup(instance)
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return admin
+	}
+	byLdapId := func(id string) map[string]string {
+		return lookup(func(instance *smc.Smc) (map[string]string, error) {
+			return smcUserIndex.AdminByLdapId(instance, id)
+		})
+	}
+
+	// the LDAP user of dave has been seen, only the details of the admin dave are loaded
+	lookup(func(instance *smc.Smc) (map[string]string, error) {
+		_, err := smcUserIndex.LdapUser(instance, "dave")
+		return nil, err
+	})
+	if admin := byLdapId("id-dave"); admin["name"] != "dave" {
+		t.Errorf("got the admin %v for id-dave", admin)
+	}
+	if loads := detailsLoaded(); loads != 1 {
+		t.Errorf("got %d loads of admin details, want 1", loads)
+	}
+
+	// the details are loaded until the admin is found, each admin once
+	smcUserIndex = newSmcUserCache()
+	if admin := byLdapId("id-bob"); admin["name"] != "bob" {
+		t.Errorf("got the admin %v for id-bob", admin)
+	}
+	if admin := byLdapId("id-missing"); admin != nil {
+		t.Errorf("got the admin %v for a missing id", admin)
+	}
+	loads := detailsLoaded()
+	if loads != 1+5 {
+		t.Errorf("got %d loads of admin details, want 6", loads)
+	}
+	for _, id := range []string{"id-alice", "id-bob", "id-carol", "id-missing"} {
+		byLdapId(id)
+	}
+	if more := detailsLoaded() - loads; more != 0 {
+		t.Errorf("got %d more loads of admin details for indexed admins", more)
+	}
+}
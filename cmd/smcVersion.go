@@ -0,0 +1,164 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"github.cicd.cloud.fpdev.io/BD/fp-smc-golang/src/smc"
+	"github.cicd.cloud.fpdev.io/BD/fp-smc-golang/src/smc/responses"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// the SMC API versions the connector is compatible with, in ascending order. SMC.API_VERSION auto selects the highest
+// of them offered by SMC. the connector was written against 6.7, the default before the negotiation, the other
+// versions are those of the SMC releases 6.5 to 7.1 serving the admin_user, role, admin_domain and
+// access_control_list elements the connector uses. a newer version is added once the connector is checked against it
+var smcApiVersions = []string{"6.5", "6.6", "6.7", "6.8", "6.9", "6.10", "6.11", "7.0", "7.1"}
+
+// the SMC API version in use, empty until it is negotiated with SMC
+var smcApiVersion = expvar.NewString("smc_api_version")
+
+// the API version is negotiated with SMC when SMC.API_VERSION is auto or empty
+func isSmcApiVersionNegotiated() bool {
+	version := strings.TrimSpace(viper.GetString("SMC.API_VERSION"))
+	return version == "" || strings.EqualFold(version, "auto")
+}
+
+// the API version configured by SMC.API_VERSION, empty when it is negotiated with SMC
+func configuredSmcApiVersion() string {
+	if isSmcApiVersionNegotiated() {
+		return ""
+	}
+	version := strings.TrimSpace(viper.GetString("SMC.API_VERSION"))
+	if !isKnownSmcApiVersion(version) {
+		logrus.Warnf("the SMC API version %s of SMC.API_VERSION is not known to be compatible with the connector, "+
+			"the known versions are %s", version, strings.Join(smcApiVersions, ", "))
+	}
+	smcApiVersion.Set(version)
+	return version
+}
+
+// query the API versions offered by SMC and select the highest one the connector is compatible with. it fails when SMC
+// offers none of them, SMC.API_VERSION can still force a version offered by SMC
+func negotiateSmcApiVersion(ctx context.Context, instance *smc.Smc) (string, error) {
+	offered, err := getSmcApiVersions(ctx, instance)
+	if err != nil {
+		return "", err
+	}
+	if len(offered) == 0 {
+		return "", fmt.Errorf("SMC offers no API version")
+	}
+	sort.Slice(offered, func(i, j int) bool {
+		return compareSmcApiVersions(offered[i], offered[j]) > 0
+	})
+	selected := ""
+	for _, version := range offered {
+		if isKnownSmcApiVersion(version) {
+			selected = version
+			break
+		}
+		logrus.Warnf("SMC offers the API version %s, which is not known to be compatible with the connector", version)
+	}
+	if selected == "" {
+		return "", fmt.Errorf("SMC offers the API versions %s, none of them is compatible with the connector. the "+
+			"compatible versions are %s", strings.Join(offered, ", "), strings.Join(smcApiVersions, ", "))
+	}
+	if selected != smcApiVersion.Value() {
+		logrus.Infof("using the SMC API version %s", selected)
+		smcApiVersion.Set(selected)
+	}
+	return selected, nil
+}
+
+// the API versions offered by SMC, listed at /api
+func getSmcApiVersions(ctx context.Context, instance *smc.Smc) ([]string, error) {
+	url := fmt.Sprintf("http://%s/api", net.JoinHostPort(instance.Hostname, instance.Port))
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	response, err := smcHttpClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, smcStatusError(response.StatusCode, "failed in loading the SMC API versions")
+	}
+	versions := &responses.ApiVersionResponse{}
+	if err := json.NewDecoder(response.Body).Decode(versions); err != nil {
+		return nil, fmt.Errorf("failed in decoding the SMC API versions: %s", err)
+	}
+	var result []string
+	for _, version := range versions.Version {
+		if version.Rel != "" {
+			result = append(result, version.Rel)
+		}
+	}
+	return result, nil
+}
+
+func isKnownSmcApiVersion(version string) bool {
+	for _, known := range smcApiVersions {
+		if compareSmcApiVersions(version, known) == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// compare two API versions number by number, so that 6.10 is higher than 6.9 and 7 is 7.0. parts which are not
+// numbers are compared as strings
+func compareSmcApiVersions(a string, b string) int {
+	partsA, partsB := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(partsA) || i < len(partsB); i++ {
+		partA, partB := "0", "0"
+		if i < len(partsA) {
+			partA = partsA[i]
+		}
+		if i < len(partsB) {
+			partB = partsB[i]
+		}
+		numberA, errA := strconv.Atoi(partA)
+		numberB, errB := strconv.Atoi(partB)
+		switch {
+		case errA == nil && errB == nil && numberA != numberB:
+			if numberA < numberB {
+				return -1
+			}
+			return 1
+		case (errA != nil || errB != nil) && partA != partB:
+			return strings.Compare(partA, partB)
+		}
+	}
+	return 0
+}
+
+// the status of the connector and of its connection to SMC
+type connectorStatus struct {
+	SmcApiVersion           string   `json:"smc_api_version"`
+	SmcApiVersionNegotiated bool     `json:"smc_api_version_negotiated"`
+	SupportedSmcApiVersions []string `json:"supported_smc_api_versions"`
+	SmcCircuitState         string   `json:"smc_circuit_state"`
+}
+
+func Status(w http.ResponseWriter, r *http.Request) {
+	status := connectorStatus{
+		SmcApiVersion:           smcApiVersion.Value(),
+		SmcApiVersionNegotiated: isSmcApiVersionNegotiated(),
+		SupportedSmcApiVersions: smcApiVersions,
+		SmcCircuitState:         smcBreaker.State(),
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(status); err != nil {
+		loggerWithField(r).Error(err.Error())
+	}
+}
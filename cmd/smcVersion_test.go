@@ -0,0 +1,79 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"github.cicd.cloud.fpdev.io/BD/fp-smc-golang/src/smc"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSmcApiVersions(t *testing.T) {
+	for i := 1; i < len(smcApiVersions); i++ {
+		if compareSmcApiVersions(smcApiVersions[i-1], smcApiVersions[i]) >= 0 {
+			t.Errorf("the API versions are not in ascending order: %s before %s", smcApiVersions[i-1],
+				smcApiVersions[i])
+		}
+	}
+	tests := []struct {
+		a, b  string
+		order int
+	}{
+		{"6.10", "6.9", 1},
+		{"7", "7.0", 0},
+		{"6.7", "6.7.1", -1},
+		{"7.1", "6.11", 1},
+	}
+	for _, test := range tests {
+		if order := compareSmcApiVersions(test.a, test.b); order != test.order {
+			t.Errorf("%s and %s: got %d, want %d", test.a, test.b, order, test.order)
+		}
+	}
+}
+
+func TestNegotiateSmcApiVersion(t *testing.T) {
+	var offered []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var versions []map[string]string
+		for _, version := range offered {
+			versions = append(versions, map[string]string{"rel": version, "href": "http://" + r.Host + "/" + version})
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"version": versions})
+	}))
+	defer server.Close()
+	host, port, err := net.SplitHostPort(server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		offered  string
+		selected string
+	}{
+		{"6.8,6.10,7.5", "6.10"},
+		{"6.5", "6.5"},
+		{"7.1,7.0,6.9", "7.1"},
+		{"7.5,8.0", ""},
+		{"", ""},
+	}
+	for _, test := range tests {
+		offered = nil
+		if test.offered != "" {
+			offered = strings.Split(test.offered, ",")
+		}
+		selected, err := negotiateSmcApiVersion(context.Background(), &smc.Smc{Hostname: host, Port: port})
+		if test.selected == "" {
+			if err == nil {
+				t.Errorf("SMC offering %q: got the version %s, want an error", test.offered, selected)
+			}
+			continue
+		}
+		if err != nil || selected != test.selected {
+			t.Errorf("SMC offering %q: got the version %q and error %v, want %s", test.offered, selected, err,
+				test.selected)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package cmd
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -9,6 +10,7 @@ import (
 	"github.cicd.cloud.fpdev.io/BD/scim-smc-connector/lib"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"strings"
@@ -19,80 +21,72 @@ var (
 	emptyString = ""
 )
 
-// get all SMC users
-func SmcUsers(id string) ([]map[string]string, error) {
+// get all SMC users, or the user with the given name or LDAP unique ID. the users are looked up in the user index
+func SmcUsers(ctx context.Context, id string) ([]map[string]string, error) {
 	var users []map[string]string
-	err := SmcInstance.Login()
-	if err != nil {
-		logrus.Fatal(err.Error())
-	}
-	body, err := SmcInstance.GetAllAdmins()
-	if err != nil {
-		return users, err
-	}
-	result, _ := utils.ResponseToMap(body)
-	admins := result["result"]
-	if id == emptyString {
-		users = admins
-	} else {
-		if strings.Contains(id, "@") {
-			parts := strings.Split(id, "@")
-			id = parts[0]
+	err := smcSession.Do(ctx, func(instance *smc.Smc) error {
+		users = nil
+		if id == emptyString {
+			var err error
+			users, err = smcUserIndex.Admins(instance)
+			return err
 		}
-		for _, admin := range admins {
-			adminUrl := admin["href"]
-			userInfo, err := GetUserSMCInfo(adminUrl)
-			if err != nil {
-				return users, err
-			}
-			parts := strings.Split(userInfo.LdapUser, "/")
-			adminId := parts[len(parts)-1]
-			if admin["name"] == id || adminId == id {
-				users = append(users, admin)
-				break
-			}
+		admin, err := smcUserIndex.Admin(instance, loginName(id))
+		if err == nil && admin == nil {
+			admin, err = smcUserIndex.AdminByLdapId(instance, id)
 		}
-	}
-	err = SmcInstance.Logout()
-	if err != nil {
-		logrus.Fatal(err.Error())
-	}
-	return users, nil
+		if err != nil {
+			return err
+		}
+		if admin != nil {
+			users = append(users, admin)
+		}
+		return nil
+	})
+	return users, err
 }
 
-// extract user's info from SMC
-func SmcUsersWithDetails(users []map[string]string) ([]UserInfo, error) {
-	err := SmcInstance.Login()
-	if err != nil {
-		logrus.Fatal(err.Error())
+// get all SMC users, or the user with the given name ignoring the case. unlike SmcUsers the name is not looked up as
+// an LDAP unique ID
+func SmcUsersByName(ctx context.Context, name string) ([]map[string]string, error) {
+	if name == emptyString {
+		return SmcUsers(ctx, name)
 	}
-	var usersInfo []UserInfo
-	for _, v := range users {
-		href := v["href"]
-		body, err := SmcInstance.GetHttp(href)
+	var users []map[string]string
+	err := smcSession.Do(ctx, func(instance *smc.Smc) error {
+		users = nil
+		admin, err := smcUserIndex.Admin(instance, loginName(name))
 		if err != nil {
-			return usersInfo, err
+			return err
 		}
-		buff, err := ioutil.ReadAll(body.Body)
-		if err != nil {
-			return usersInfo, err
+		if admin != nil {
+			users = append(users, admin)
 		}
-		var info UserInfo
-		if err := json.Unmarshal(buff, &info); err != nil {
-			return usersInfo, err
+		return nil
+	})
+	return users, err
+}
+
+// extract user's info from SMC
+func SmcUsersWithDetails(ctx context.Context, users []map[string]string) ([]UserInfo, error) {
+	var usersInfo []UserInfo
+	err := smcSession.Do(ctx, func(instance *smc.Smc) error {
+		usersInfo = nil
+		for _, v := range users {
+			info, err := smcUserIndex.Details(instance, v["href"])
+			if err != nil {
+				return err
+			}
+			usersInfo = append(usersInfo, info)
 		}
-		usersInfo = append(usersInfo, info)
-	}
-	err = SmcInstance.Logout()
-	if err != nil {
-		logrus.Fatal(err.Error())
-	}
-	return usersInfo, nil
+		return nil
+	})
+	return usersInfo, err
 }
 
 //validate if a given username is exist in SMC
-func validateUser(userName string) (bool, error) {
-	users, err := SmcUsers(userName)
+func validateUser(ctx context.Context, userName string) (bool, error) {
+	users, err := SmcUsers(ctx, userName)
 	if err != nil {
 		return false, err
 	}
@@ -105,57 +99,57 @@ func validateUser(userName string) (bool, error) {
 	return true, nil
 }
 
-// create a new user
-func CreateUser(userName string, active bool) (string, int, error) {
-	var returnError error
-	returnError = nil
-	httpStatus := http.StatusCreated
-	err := SmcInstance.Login()
-	if err != nil {
-		logrus.Fatal(err.Error())
+// create a new user. the user must exist in the LDAP domain of SMC, the lookup is retried LDAP_LOOKUP_RETRIES times
+// since a user just created in the identity provider may take a while to be replicated to the domain
+func CreateUser(ctx context.Context, userName string, active bool) (string, error) {
+	var ldapUserHref string
+	retries := viper.GetInt("LDAP_LOOKUP_RETRIES")
+	for attempt := 0; ; attempt++ {
+		err := smcSession.Do(ctx, func(instance *smc.Smc) error {
+			var err error
+			ldapUserHref, err = findLdapUser(instance, userName)
+			return err
+		})
+		if err != nil {
+			return "", err
+		}
+		if ldapUserHref != "" {
+			break
+		}
+		if attempt >= retries {
+			return "", newScimError(http.StatusNotFound, "noTarget",
+				"the user %s is not found in the LDAP search bases %s of SMC, the admin is not created", userName,
+				strings.Join(ldapSearchBases(), ", "))
+		}
+		delay := time.Duration(viper.GetInt("LDAP_LOOKUP_RETRY_DELAY_IN_SECONDS")) * time.Second
+		logrus.Infof("the user %s is not found in the LDAP domain yet, retrying in %s", userName, delay)
+		if err := lib.SleepContext(ctx, delay); err != nil {
+			return "", smcTimeoutError(err)
+		}
 	}
-	var userLdap smc.LDAPUser
+	var userHref string
+	err := smcSession.Do(ctx, func(instance *smc.Smc) error {
+		var err error
+		userHref, err = createUser(instance, userName, active, ldapUserHref)
+		return err
+	})
+	return userHref, err
+}
+
+func createUser(instance *smc.Smc, userName string, active bool, userHref string) (string, error) {
 	//find external LDAP Auth
-	ldapAuthService, err := SmcInstance.FindExternalLdap()
+	ldapAuthService, err := instance.FindExternalLdap()
 	if err != nil {
-		returnError = err
-		httpStatus = http.StatusBadRequest
-		return "", httpStatus, returnError
+		return "", err
 	}
 	authMethod := ldapAuthService["href"]
-	ldapDomain, err := SmcInstance.ExternalLdapDomain(viper.GetString("LDAP_DOMAIN"))
-	if err != nil {
-		returnError = err
-		httpStatus = http.StatusBadRequest
-		return "", httpStatus, returnError
+	if authMethod == "" || userHref == "" {
+		return "", newScimError(http.StatusNotFound, "noTarget", "the LDAP user %s is not found", userName)
 	}
-	url := ldapDomain["href"] + "/browse"
-	azureAd, err := SmcInstance.GetHttp(url)
-	rep, err := utils.ResponseToMap(azureAd.Body)
+	permissions, superUser, err := generateDefaultPermissions(instance)
 	if err != nil {
-		returnError = err
-		httpStatus = http.StatusBadRequest
-		return "", httpStatus, returnError
-	}
-	for _, r := range rep["result"] {
-		if r["name"] == "AADDC Users" {
-			users, _ := SmcInstance.FindAllUsers(r["href"])
-			for _, user := range users {
-				u, _ := SmcInstance.ExternalAldapUser(user["href"])
-				if u.Name == userName {
-					userLdap = u
-				}
-			}
-		}
+		return "", err
 	}
-
-	var userHref string
-	for _, l := range userLdap.Link {
-		if l["rel"] == "self" {
-			userHref = l["href"]
-		}
-	}
-	permissions, superUser := generateDefaultPermissions()
 	user := smc.UserCreation{
 		Name:                   userName,
 		Enabled:                active,
@@ -172,276 +166,531 @@ func CreateUser(userName string, active bool) (string, int, error) {
 		Permissions:            permissions,
 	}
 
-	if !SmcInstance.SetCookie {
-		err := SmcInstance.Login()
-		if err != nil {
-			logrus.Fatal(err.Error())
-		}
-	}
-	_, httpStatus, err = SmcInstance.CreateAdmin(&user)
+	body, httpStatus, err := instance.CreateAdmin(&user)
+	smcUserIndex.InvalidateAdmins()
 	if err != nil {
-		returnError = err
-		logrus.Debug("Error4: " + err.Error())
+		return "", err
 	}
-	if httpStatus == http.StatusUnprocessableEntity {
-		returnError = errors.New(fmt.Sprintf("User name %s is already exist", userName))
+	if closer, ok := body.(io.Closer); ok {
+		defer closer.Close()
 	}
-	if httpStatus != http.StatusCreated {
-		returnError = errors.New(fmt.Sprintf("unexpected http status code: %d is recieved ", httpStatus))
+	switch httpStatus {
+	case http.StatusCreated:
+		return userHref, nil
+	case http.StatusUnauthorized:
+		return "", errSmcUnauthorized
+	case http.StatusUnprocessableEntity:
+		return "", uniquenessError("User name %s is already exist", userName)
 	}
-	err = SmcInstance.Logout()
-	if err != nil {
-		logrus.Fatal(err.Error())
-	}
-	return userHref, httpStatus, returnError
+	return "", smcStatusError(httpStatus, "failed in creating the user %s", userName)
 }
 
-// enable or disable a user
-func EnableDisableUser(userId string) (bool, error) {
-	user, err := SmcUsers(userId)
-	if err != nil {
-		return false, err
-	}
-	if user == nil {
-		return false, errors.New("user not found")
-	}
-	err = SmcInstance.Login()
-	if err != nil {
-		logrus.Fatal(err.Error())
+// the OUs of the LDAP domain the users are searched in. LDAP_USERS_OU is used when no LDAP_SEARCH_BASES is configured
+func ldapSearchBases() []string {
+	if bases := viper.GetStringSlice("LDAP_SEARCH_BASES"); len(bases) != 0 {
+		return bases
 	}
+	return []string{viper.GetString("LDAP_USERS_OU")}
+}
 
-	for _, u := range user {
-		if u["name"] == userId {
-			response, err := SmcInstance.DisableEnableUser(userId, u["href"])
-			if err != nil {
-				return false, err
-			}
-			if response.StatusCode != http.StatusOK {
-				return false, errors.New(fmt.Sprintf("unexpected http status: %d ", response.StatusCode))
+// find the href of a user of the LDAP search bases of SMC, empty if the user is not found
+func findLdapUser(instance *smc.Smc, userName string) (string, error) {
+	return smcUserIndex.LdapUser(instance, userName)
+}
+
+// the href of the element at a path of names below an LDAP element, empty if the path does not exist
+func browseLdapPath(instance *smc.Smc, href string, path string) (string, error) {
+	for _, name := range strings.Split(path, "/") {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+		children, err := browseLdap(instance, href)
+		if err != nil {
+			return "", err
+		}
+		href = ""
+		for _, child := range children {
+			if strings.EqualFold(child["name"], name) {
+				href = child["href"]
+				break
 			}
 		}
+		if href == "" {
+			return "", nil
+		}
 	}
-	err = SmcInstance.Logout()
-	if err != nil {
-		logrus.Fatal(err.Error())
+	return href, nil
+}
+
+// search a user below an LDAP element and all its child elements, the href of the user is empty if it is not found.
+// the users of the browsed elements are added to users, names already in it are kept
+func browseLdapUser(instance *smc.Smc, href string, userName string, users map[string]string,
+	visited map[string]bool) (string, error) {
+	visited[href] = true
+	children, err := browseLdap(instance, href)
+	if err != nil {
+		return "", err
+	}
+	for _, child := range children {
+		if child["type"] != "external_ldap_user" {
+			continue
+		}
+		if _, ok := users[child["name"]]; !ok {
+			users[child["name"]] = child["href"]
+		}
 	}
-	return true, nil
+	if userHref, ok := users[userName]; ok {
+		return userHref, nil
+	}
+	for _, child := range children {
+		if child["type"] == "external_ldap_user" || child["href"] == "" || visited[child["href"]] {
+			continue
+		}
+		userHref, err := browseLdapUser(instance, child["href"], userName, users, visited)
+		if err != nil || userHref != "" {
+			return userHref, err
+		}
+	}
+	return "", nil
 }
 
-// load all exists SMC roles which can be assigned to a user
-func GetRoles() (map[string]string, error) {
-	smcRoles := make(map[string][]map[string]string)
-	roles := make(map[string]string)
-	response, err := SmcInstance.GetHttp(fmt.Sprintf("http://%s:%s/%s/elements/role",
-		SmcInstance.Hostname, SmcInstance.Port, SmcInstance.APIVersion))
+// the child elements of an LDAP element
+func browseLdap(instance *smc.Smc, href string) ([]map[string]string, error) {
+	response, err := checkSmcResponse(instance.GetHttp(href + "/browse"))
 	if err != nil {
-		return roles, err
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, smcStatusError(response.StatusCode, "failed in browsing the LDAP domain of SMC")
 	}
-	if response == nil {
-		return roles, err
+	result, err := utils.ResponseToMap(response.Body)
+	if err != nil {
+		return nil, err
 	}
-	if response.StatusCode == http.StatusOK {
+	return result["result"], nil
+}
 
-		buff, err := ioutil.ReadAll(response.Body)
+// set the enabled state of a user. SMC only offers a toggle, so the state is written only when it differs from the
+// requested one. the returned bool reports whether the state has been changed
+func SetUserActive(ctx context.Context, userUrl string, active bool) (bool, error) {
+	changed := false
+	err := smcSession.Do(ctx, func(instance *smc.Smc) error {
+		userData, err := GetUserData(instance, userUrl)
 		if err != nil {
-			return roles, err
+			return err
 		}
-		if err := json.Unmarshal(buff, &smcRoles); err != nil {
-			return roles, err
+		if userData.Enabled == active {
+			return nil
 		}
+		response, err := checkSmcResponse(instance.DisableEnableUser(userData.Name, userUrl))
+		smcUserIndex.InvalidateAdmin(userUrl)
+		if err != nil {
+			return err
+		}
+		defer response.Body.Close()
+		if response.StatusCode != http.StatusOK {
+			return smcStatusError(response.StatusCode, "failed in enabling or disabling the user %s",
+				userData.Name)
+		}
+		changed = true
+		return nil
+	})
+	return changed, err
+}
+
+// load all exists SMC roles which can be assigned to a user
+func GetRoles(instance *smc.Smc) (map[string]string, error) {
+	return smcElements.Hrefs(instance, smcRoleElement)
+}
+
+// the SMC elements a permission is made of, each by their name
+type PermissionElements struct {
+	Roles           map[string]string
+	Domains         map[string]string
+	GrantedElements map[string]string
+}
+
+func loadPermissionElements(instance *smc.Smc) (*PermissionElements, error) {
+	var elements PermissionElements
+	var err error
+	if elements.Roles, err = GetRoles(instance); err != nil {
+		return nil, err
+	}
+	if elements.Domains, err = smcElements.Hrefs(instance, smcAdminDomainElement); err != nil {
+		return nil, err
 	}
-	for _, role := range smcRoles["result"] {
-		roles[role["name"]] = role["href"]
+	if elements.GrantedElements, err = smcElements.Hrefs(instance, smcAccessControlListElement); err != nil {
+		return nil, err
 	}
+	return &elements, nil
+}
 
-	return roles, nil
+// load all exists SMC roles, admin domains and access control lists
+func GetPermissionElements(ctx context.Context) (*PermissionElements, error) {
+	var elements *PermissionElements
+	err := smcSession.Do(ctx, func(instance *smc.Smc) error {
+		var err error
+		elements, err = loadPermissionElements(instance)
+		return err
+	})
+	return elements, err
 }
 
-// get users name from SMC
-func GetAllUsersName() ([]string, error) {
-	var users []string
-	body, err := SmcInstance.GetAllAdmins()
-	if err != nil {
-		return users, err
-	}
-	result, err := utils.ResponseToMap(body)
+// load all exists SMC roles by their name
+func GetAllRoles(ctx context.Context) (map[string]string, error) {
+	var roles map[string]string
+	err := smcSession.Do(ctx, func(instance *smc.Smc) error {
+		var err error
+		roles, err = GetRoles(instance)
+		return err
+	})
+	return roles, err
+}
+
+// load the names of all SMC roles by their href
+func GetRoleNames(ctx context.Context) (map[string]string, error) {
+	roleNames := make(map[string]string)
+	roles, err := GetAllRoles(ctx)
 	if err != nil {
-		return users, err
+		return roleNames, err
 	}
-	for _, user := range result["result"] {
-		users = append(users, user["name"])
+	for name, href := range roles {
+		roleNames[href] = name
 	}
-	return users, nil
+	return roleNames, nil
 }
 
-// map between users and roles
-func MapUsersToRoles() (map[string][]string, error) {
-	usersWithRoles := make(map[string][]string)
-	groupNames := strings.Split("Editor,Operator,Owner,Viewer,Superuser,NSX Role,Logs Viewer,Reports Manager,Monitor",
-		",")
-	smcUsers, err := GetAllUsersName()
+// the permission granting a role in the default admin domain on the default access control list, the shared domain
+// and all elements unless configured otherwise
+func rolePermission(instance *smc.Smc, roleUrl string) (smc.Permission, error) {
+	permission := smc.Permission{RoleRef: roleUrl}
+	domainName := viper.GetString("SMC.DEFAULT_DOMAIN")
+	domainRef, err := smcElements.Href(instance, smcAdminDomainElement, domainName)
 	if err != nil {
-
+		return permission, err
 	}
-	ldapDom, err := SmcInstance.ExternalLdapDomain(viper.GetString("LDAP_DOMAIN"))
-	if err != nil {
-		return usersWithRoles, err
+	if domainRef == "" {
+		return permission, fmt.Errorf("the admin domain %s does not exist on SMC", domainName)
 	}
-	url := ldapDom["href"] + "/browse"
-	azureAd, err := SmcInstance.GetHttp(url)
+	aclName := viper.GetString("SMC.DEFAULT_GRANTED_ELEMENTS")
+	aclRef, err := smcElements.Href(instance, smcAccessControlListElement, aclName)
 	if err != nil {
-		return usersWithRoles, err
-	}
-	if azureAd == nil {
-		return usersWithRoles, errors.New("got an empty response while mapping users to roles")
-	}
-	rep, _ := utils.ResponseToMap(azureAd.Body)
-	for _, r := range rep["result"] {
-		// find all groups and users of azure AD
-		if r["name"] == "AADDC Users" {
-			groups, _ := SmcInstance.FindAllGroups(r["href"])
-			for _, group := range groups {
-				if !lib.StringInSlice(group["name"], groupNames) {
-					continue
-				}
-				users, _ := SmcInstance.FindAllUsers(group["href"])
-				for _, user := range users {
-					u, _ := SmcInstance.ExternalAldapUser(user["href"])
-					//is user is a SMC user
-					if lib.StringInSlice(u.Name, smcUsers) {
-						if _, ok := usersWithRoles[u.Name]; !ok {
-							usersWithRoles[u.Name] = []string{}
-						}
-						usersWithRoles[u.Name] = append(usersWithRoles[u.Name], group["name"])
-					}
-				}
+		return permission, err
+	}
+	if aclRef == "" {
+		return permission, fmt.Errorf("the access control list %s does not exist on SMC", aclName)
+	}
+	permission.GrantedDomainRef = domainRef
+	permission.GrantedElements = []string{aclRef}
+	return permission, nil
+}
+
+// the permissions granting a role in the given admin domains on the given access control lists. the default domain and
+// access control list are used when no names are given. names missing on SMC are reported as invalid value, so that
+// the roles of an admin are never replaced with a part of its permissions
+func grantPermissions(instance *smc.Smc, roleUrl string, domains []string, grantedElements []string) ([]smc.Permission,
+	error) {
+	defaultPermission, err := rolePermission(instance, roleUrl)
+	if err != nil {
+		return nil, err
+	}
+	elementRefs := defaultPermission.GrantedElements
+	if len(grantedElements) != 0 {
+		elementRefs = []string{}
+		for _, name := range grantedElements {
+			href, err := smcElements.Href(instance, smcAccessControlListElement, name)
+			if err != nil {
+				return nil, err
+			}
+			if href == "" {
+				return nil, invalidValueError("the access control list %s does not exist on SMC", name)
 			}
+			elementRefs = append(elementRefs, href)
 		}
 	}
-	return usersWithRoles, nil
+	if len(domains) == 0 {
+		defaultPermission.GrantedElements = elementRefs
+		return []smc.Permission{defaultPermission}, nil
+	}
+	var permissions []smc.Permission
+	for _, name := range domains {
+		href, err := smcElements.Href(instance, smcAdminDomainElement, name)
+		if err != nil {
+			return nil, err
+		}
+		if href == "" {
+			return nil, invalidValueError("the admin domain %s does not exist on SMC", name)
+		}
+		permissions = append(permissions, smc.Permission{GrantedDomainRef: href, GrantedElements: elementRefs,
+			RoleRef: roleUrl})
+	}
+	return permissions, nil
+}
+
+// the permissions granting a role through SCIM. the role is granted in the admin domains and on the access control
+// lists of the first role mapping granting it, so that ApplyRoles finds the same permissions on the members of mapped
+// groups and does not rewrite them. a role of no mapping is granted like the roles of new admins, with ROLES.DOMAINS
+// and ROLES.GRANTED_ELEMENTS
+func scimRolePermissions(instance *smc.Smc, roleName string, roleUrl string) ([]smc.Permission, error) {
+	mappings, err := LoadRoleMappings()
+	if err != nil {
+		return nil, err
+	}
+	for _, mapping := range mappings {
+		if lib.StringInSlice(roleName, mapping.Roles) {
+			return grantPermissions(instance, roleUrl, mapping.Domains, mapping.GrantedElements)
+		}
+	}
+	return grantPermissions(instance, roleUrl, viper.GetStringSlice("ROLES.DOMAINS"),
+		viper.GetStringSlice("ROLES.GRANTED_ELEMENTS"))
 }
 
-// this function will be called in a goroutine, the goal of this function is to read all azure ldap groups and apply
-// the required roles on their members.
-func ApplyRoles() {
-	if !SmcInstance.SetCookie {
-		err := SmcInstance.Login()
+// set the permissions of a user to the given roles. the Superuser role excludes all other roles
+func setUserRoles(instance *smc.Smc, userData *smc.UserData, roleNames []string, roles map[string]string) error {
+	permissions := []smc.Permission{}
+	userData.Superuser = false
+	for _, name := range roleNames {
+		roleUrl, ok := roles[name]
+		if !ok {
+			return invalidValueError("the role %s does not exist in SMC", name)
+		}
+		granted, err := scimRolePermissions(instance, name, roleUrl)
 		if err != nil {
-			logrus.Fatal(err.Error())
+			return err
 		}
+		if name == "Superuser" {
+			permissions = granted
+			userData.Superuser = true
+			break
+		}
+		permissions = append(permissions, granted...)
+	}
+	if userData.Permissions == nil {
+		userData.Permissions = make(map[string][]smc.Permission)
 	}
-	roles, err := GetRoles()
-	if err != nil || len(roles) == 0 {
-		time.Sleep(2 * time.Minute)
-		roles, err = GetRoles()
+	userData.Permissions["permission"] = permissions
+	return nil
+}
+
+// load a SMC admin, apply the given changes on it and write it back to SMC. the update function reports whether
+// the admin has been changed, unchanged admins are not written. the returned bool reports if a change is written
+func UpdateSmcUser(ctx context.Context, userUrl string,
+	update func(instance *smc.Smc, userData *smc.UserData) (bool, error)) (bool, error) {
+	changed := false
+	err := smcSession.Do(ctx, func(instance *smc.Smc) error {
+		changed = false
+		userData, err := GetUserData(instance, userUrl)
+		if err != nil {
+			return err
+		}
+		name := userData.Name
+		updated, err := update(instance, &userData)
+		if err != nil || !updated {
+			return err
+		}
+		response, err := checkSmcResponse(instance.UpdateUser(&userData))
+		if userData.Name != name {
+			// the admins are indexed by their name
+			smcUserIndex.InvalidateAdmins()
+		} else {
+			smcUserIndex.InvalidateAdmin(userUrl)
+		}
+		if err != nil {
+			return err
+		}
+		defer response.Body.Close()
+		if response.StatusCode != http.StatusOK {
+			// the update may refer to elements removed from SMC since they were cached
+			smcElements.Invalidate()
+			return smcStatusError(response.StatusCode, "failed in updating the user %s", userData.Name)
+		}
+		changed = true
+		return nil
+	})
+	return changed, err
+}
+
+// grant a role to a user, in the admin domains and on the access control lists of its role mapping. the Superuser
+// role replaces all other roles of the user
+func GrantUserRole(ctx context.Context, userUrl string, roleName string, roleUrl string) (bool, error) {
+	return UpdateSmcUser(ctx, userUrl, func(instance *smc.Smc, userData *smc.UserData) (bool, error) {
+		permissions := userData.Permissions["permission"]
+		for _, p := range permissions {
+			if p.RoleRef == roleUrl {
+				return false, nil
+			}
+		}
+		if roleName == "Superuser" {
+			permissions = nil
+			userData.Superuser = true
+		}
+		granted, err := scimRolePermissions(instance, roleName, roleUrl)
+		if err != nil {
+			return false, err
+		}
+		if userData.Permissions == nil {
+			userData.Permissions = make(map[string][]smc.Permission)
+		}
+		userData.Permissions["permission"] = append(permissions, granted...)
+		return true, nil
+	})
+}
+
+// revoke a role from a user
+func RevokeUserRole(ctx context.Context, userUrl string, roleName string, roleUrl string) (bool, error) {
+	return UpdateSmcUser(ctx, userUrl, func(instance *smc.Smc, userData *smc.UserData) (bool, error) {
+		permissions := []smc.Permission{}
+		for _, p := range userData.Permissions["permission"] {
+			if p.RoleRef != roleUrl {
+				permissions = append(permissions, p)
+			}
+		}
+		if len(permissions) == len(userData.Permissions["permission"]) {
+			return false, nil
+		}
+		if roleName == "Superuser" {
+			userData.Superuser = false
+		}
+		userData.Permissions["permission"] = permissions
+		return true, nil
+	})
+}
+
+// map the SMC users to the roles of their groups in the identity source
+func MapUsersToRoles(source IdentitySource, mappings []RoleMapping, smcUsers []string) (map[string][]RoleGrant,
+	error) {
+	usersWithRoles := make(map[string][]RoleGrant)
+	for _, user := range smcUsers {
+		groups, err := source.UserGroups(user)
 		if err != nil {
-			logrus.Errorf("Error occur in loading all roles. Error: %s", err)
-			return
+			return usersWithRoles, err
 		}
+		if roles := mappedRoles(mappings, groups); len(roles) != 0 {
+			usersWithRoles[user] = roles
+		}
+	}
+	return usersWithRoles, nil
+}
+
+// this function will be called in a goroutine, the goal of this function is to read the groups of the identity source
+// and apply the required roles on their members. the role mappings win over the roles granted through SCIM: the
+// roles of the members of mapped groups are replaced with the roles of their mappings. a failed run is retried by the caller in its next run. the SMC
+// session is taken for each step only, so the requests of the SCIM clients are not blocked while the roles are applied
+func ApplyRoles(ctx context.Context, source IdentitySource, mappings []RoleMapping) error {
+	elements, err := GetPermissionElements(ctx)
+	if err != nil {
+		return fmt.Errorf("failed in loading all roles: %s", err)
+	}
+	if len(elements.Roles) == 0 {
+		return errors.New("failed in loading all roles: SMC has no roles")
+	}
+	if !isRoleMappingConfigured() {
+		// the default mappings of the roles missing on SMC are skipped, they are reported on startup
+		var existing []RoleMapping
+		for _, mapping := range mappings {
+			if _, ok := elements.Roles[mapping.Roles[0]]; ok {
+				existing = append(existing, mapping)
+			}
+		}
+		mappings = existing
 	}
 
 	usersUrl := make(map[string]string)
-	admins, _ := SmcInstance.GetAllAdmins()
+	err = smcSession.Do(ctx, func(instance *smc.Smc) error {
+		admins, err := smcUserIndex.Admins(instance)
+		if err != nil {
+			return fmt.Errorf("failed in loading the exists users: %s", err)
+		}
+		for _, u := range admins {
+			usersUrl[u["name"]] = u["href"]
+		}
+		return nil
+	})
 	if err != nil {
-		logrus.Errorf("Error occur in updating the user's roles. Error: %s", err)
-		return
-
+		return err
 	}
-	if admins == nil {
-		logrus.Error("Failed to communicate with Forcepoint SMC in order to load exists users. ensure the hostname and the --key are correct")
-		return
+	var smcUsers []string
+	for name := range usersUrl {
+		smcUsers = append(smcUsers, name)
 	}
-	result, _ := utils.ResponseToMap(admins)
-	for _, u := range result["result"] {
-		usersUrl[u["name"]] = u["href"]
+	usersWithRoles, err := MapUsersToRoles(source, mappings, smcUsers)
+	if err != nil {
+		return fmt.Errorf("failed in mapping users to roles: %s", err)
 	}
-
-	usersWithRoles, err := MapUsersToRoles()
-	for user, userRole := range usersWithRoles {
+	for user, grants := range usersWithRoles {
+		if len(grants) == 0 {
+			continue
+		}
 		var appliedRoles []string
-		if len(userRole) != 0 {
+		changed, err := UpdateSmcUser(ctx, usersUrl[user], func(instance *smc.Smc, userData *smc.UserData) (bool, error) {
+			appliedRoles = nil
 			permissions := make(map[string][]smc.Permission)
 			permissions["permission"] = []smc.Permission{}
-			userData, err := GetUserData(usersUrl[user])
-			if err != nil {
-				logrus.Errorf("Error occur in loading user's SMC data. Error: %s", err)
-				return
-			}
-			for _, role := range userRole {
-				roleUrl := roles[role]
-				if role == "Superuser" {
-					grantedElements := fmt.Sprintf("http://%s:%s/%s/elements/access_control_list/7",
-						SmcInstance.Hostname,
-						SmcInstance.Port,
-						SmcInstance.APIVersion)
-					permission := smc.Permission{
-						GrantedDomainRef: fmt.Sprintf("http://%s:%s/%s/elements/admin_domain/1",
-							SmcInstance.Hostname,
-							SmcInstance.Port,
-							SmcInstance.APIVersion),
-						GrantedElements: []string{grantedElements},
-						RoleRef:         roleUrl,
-					}
-					permissions["permission"] = make([]smc.Permission, 0)
-					permissions["permission"] = append(permissions["permission"], permission)
+			for _, grant := range grants {
+				roleUrl, ok := elements.Roles[grant.Role]
+				if !ok {
+					return false, invalidValueError("the role %s does not exist on SMC", grant.Role)
+				}
+				granted, err := grantPermissions(instance, roleUrl, grant.Domains, grant.GrantedElements)
+				if err != nil {
+					return false, err
+				}
+				if grant.Role == "Superuser" {
+					permissions["permission"] = granted
 					userData.Superuser = true
-					appliedRoles = []string{role}
+					appliedRoles = []string{grant.Role}
 					break
 				} else {
-					grantedElements := fmt.Sprintf("http://%s:%s/%s/elements/access_control_list/7",
-						SmcInstance.Hostname,
-						SmcInstance.Port,
-						SmcInstance.APIVersion)
-					permission := smc.Permission{
-						GrantedDomainRef: fmt.Sprintf("http://%s:%s/%s/elements/admin_domain/1",
-							SmcInstance.Hostname,
-							SmcInstance.Port,
-							SmcInstance.APIVersion),
-						GrantedElements: []string{grantedElements},
-						RoleRef:         roleUrl,
-					}
-					permissions["permission"] = append(permissions["permission"], permission)
+					permissions["permission"] = append(permissions["permission"], granted...)
 				}
 				userData.Superuser = false
-				appliedRoles = append(appliedRoles, role)
-			}
-			result := lib.CompareRoles(userData.Permissions["permission"], permissions["permission"])
-			if !result {
-				userData.Permissions = permissions
-				response, err := SmcInstance.UpdateUser(&userData)
-				if err != nil {
-					logrus.Errorf("Error occur in updating the user's roles. Error: %s", err)
+				if !lib.StringInSlice(grant.Role, appliedRoles) {
+					appliedRoles = append(appliedRoles, grant.Role)
 				}
-				if response.StatusCode != http.StatusOK {
-					logrus.Errorf("Error occur in updating the user's roles. http status code: %d",
-						response.StatusCode)
-				} else {
-					newRoles := strings.Join(appliedRoles, ", ")
-					logrus.Infof("new roles: user=%s, roles: %s", user, newRoles)
-				}
-
-				time.Sleep(1 * time.Second)
+			}
+			if lib.CompareRoles(userData.Permissions["permission"], permissions["permission"]) {
+				return false, nil
+			}
+			userData.Permissions = permissions
+			return true, nil
+		})
+		var scimErr *scimError
+		if errors.As(err, &scimErr) && scimErr.scimType == "invalidValue" {
+			// the mapping of this user refers to elements missing on SMC, the user keeps its roles
+			logrus.Errorf("the roles of user %s are not updated: %s", user, err)
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed in updating the roles of user %s: %s", user, err)
+		}
+		if changed {
+			newRoles := strings.Join(appliedRoles, ", ")
+			logrus.Infof("new roles: user=%s, roles: %s", user, newRoles)
+			if err := lib.SleepContext(ctx, 1*time.Second); err != nil {
+				return err
 			}
 		}
 	}
-
-	err = SmcInstance.Logout()
-	if err != nil {
-		logrus.Fatal(err.Error())
-	}
+	return nil
 }
 
 // get all info related to a SMC user
-func GetUserData(userUrl string) (smc.UserData, error) {
+func GetUserData(instance *smc.Smc, userUrl string) (smc.UserData, error) {
 	var userData smc.UserData
-	response, err := SmcInstance.GetHttp(userUrl)
-	if response == nil {
+	response, err := checkSmcResponse(instance.GetHttp(userUrl))
+	if err != nil {
 		return userData, err
 	}
+	defer response.Body.Close()
+	// an error body would decode to an empty admin, which must never be written back
+	if response.StatusCode != http.StatusOK {
+		return userData, smcStatusError(response.StatusCode, "failed in loading the user %s", userUrl)
+	}
+	buffer, err := ioutil.ReadAll(response.Body)
 	if err != nil {
 		return userData, err
 	}
-	buffer, err := ioutil.ReadAll(response.Body)
 	if err := json.Unmarshal(buffer, &userData); err != nil {
 		return userData, err
 	}
@@ -450,41 +699,25 @@ func GetUserData(userUrl string) (smc.UserData, error) {
 
 // generate the defaults roles and permissions for a new users.
 // the default roles and permissions can be defined in the config file
-func generateDefaultPermissions() (map[string][]smc.Permission, bool) {
+func generateDefaultPermissions(instance *smc.Smc) (map[string][]smc.Permission, bool, error) {
 	perNames := []string{"VIEWER", "LOGS_VIEWER",
 		"REPORTS_MANAGER", "OWNER", "OPERATOR", "MONITOR", "EDITOR",
 		"NSX_ROLE"}
 	permissions := make(map[string][]smc.Permission)
 	permissions["permission"] = []smc.Permission{}
-	if !SmcInstance.SetCookie {
-		err := SmcInstance.Login()
-		if err != nil {
-			logrus.Fatal(err.Error())
-		}
-	}
-	roles, err := GetRoles()
-	if err != nil {
-		logrus.Errorf("Error in getting all exist roles from SMC: %s", err.Error())
-	}
-	err = SmcInstance.Logout()
+	roles, err := GetRoles(instance)
 	if err != nil {
-		logrus.Fatal(err.Error())
+		return permissions, false, err
 	}
+	domains := viper.GetStringSlice("ROLES.DOMAINS")
+	grantedElements := viper.GetStringSlice("ROLES.GRANTED_ELEMENTS")
 	if viper.GetBool("ROLES.PERMISSIONS.SUPPER_USER") {
-		grantedElements := fmt.Sprintf("http://%s:%s/%s/elements/access_control_list/7",
-			SmcInstance.Hostname,
-			SmcInstance.Port,
-			SmcInstance.APIVersion)
-		permission := smc.Permission{
-			GrantedDomainRef: fmt.Sprintf("http://%s:%s/%s/elements/admin_domain/1",
-				SmcInstance.Hostname,
-				SmcInstance.Port,
-				SmcInstance.APIVersion),
-			GrantedElements: []string{grantedElements},
-			RoleRef:         roles["Superuser"],
-		}
-		permissions["permission"] = append(permissions["permission"], permission)
-		return permissions, true
+		permission, err := grantPermissions(instance, roles["Superuser"], domains, grantedElements)
+		if err != nil {
+			return permissions, false, err
+		}
+		permissions["permission"] = append(permissions["permission"], permission...)
+		return permissions, true, nil
 	} else {
 		for _, p := range perNames {
 			viperName := fmt.Sprintf("ROLES.PERMISSIONS.%s", p)
@@ -492,35 +725,49 @@ func generateDefaultPermissions() (map[string][]smc.Permission, bool) {
 				roleName := strings.ReplaceAll(p, "_", " ")
 				roleName = strings.ToLower(roleName)
 				roleName = strings.Title(roleName)
-				grantedElements := fmt.Sprintf("http://%s:%s/%s/elements/access_control_list/7",
-					SmcInstance.Hostname,
-					SmcInstance.Port,
-					SmcInstance.APIVersion)
-				permission := smc.Permission{
-					GrantedDomainRef: fmt.Sprintf("http://%s:%s/%s/elements/admin_domain/1",
-						SmcInstance.Hostname,
-						SmcInstance.Port,
-						SmcInstance.APIVersion),
-					GrantedElements: []string{grantedElements},
-					RoleRef:         roles[roleName],
+				permission, err := grantPermissions(instance, roles[roleName], domains, grantedElements)
+				if err != nil {
+					return permissions, false, err
 				}
-				permissions["permission"] = append(permissions["permission"], permission)
+				permissions["permission"] = append(permissions["permission"], permission...)
 			}
 		}
 	}
-	return permissions, false
+	return permissions, false, nil
 }
 
-func GetUserSMCInfo(href string) (UserInfo, error) {
-	err := SmcInstance.Login()
-	if err != nil {
-		logrus.Fatal(err.Error())
-	}
+func GetUserSMCInfo(ctx context.Context, href string) (UserInfo, error) {
 	var usersInfo UserInfo
-	body, err := SmcInstance.GetHttp(href)
+	err := smcSession.Do(ctx, func(instance *smc.Smc) error {
+		var err error
+		usersInfo, err = smcUserIndex.Details(instance, href)
+		return err
+	})
+	return usersInfo, err
+}
+
+// load the details of a SMC admin from SMC, bypassing the user index. used to decide changes on the current state of
+// the admin
+func ReloadUserSMCInfo(ctx context.Context, href string) (UserInfo, error) {
+	var usersInfo UserInfo
+	err := smcSession.Do(ctx, func(instance *smc.Smc) error {
+		var err error
+		usersInfo, err = smcUserIndex.Reload(instance, href)
+		return err
+	})
+	return usersInfo, err
+}
+
+func getUserSMCInfo(instance *smc.Smc, href string) (UserInfo, error) {
+	var usersInfo UserInfo
+	body, err := checkSmcResponse(instance.GetHttp(href))
 	if err != nil {
 		return usersInfo, err
 	}
+	defer body.Body.Close()
+	if body.StatusCode != http.StatusOK {
+		return usersInfo, smcStatusError(body.StatusCode, "failed in loading the user %s", href)
+	}
 	buff, err := ioutil.ReadAll(body.Body)
 	if err != nil {
 		return usersInfo, err
@@ -528,70 +775,60 @@ func GetUserSMCInfo(href string) (UserInfo, error) {
 	if err := json.Unmarshal(buff, &usersInfo); err != nil {
 		return usersInfo, err
 	}
-	err = SmcInstance.Logout()
-	if err != nil {
-		logrus.Fatal(err.Error())
-	}
 	return usersInfo, nil
 }
 
-func DeleteSmcUser(userName string) error {
-	err := SmcInstance.Login()
-	if err != nil {
-		logrus.Fatal(err.Error())
-	}
-	defer SmcInstance.Logout()
-	resp, err := SmcInstance.DeleteAdmin(userName)
-	if err != nil {
-		return err
-	}
-	if resp.StatusCode != http.StatusNoContent {
-		return errors.New(fmt.Sprintf("got unexpected http status code: %d from deleting a user", resp.StatusCode))
-	}
-	return nil
+func DeleteSmcUser(ctx context.Context, userName string) error {
+	return smcSession.Do(ctx, func(instance *smc.Smc) error {
+		resp, err := checkSmcResponse(instance.DeleteAdmin(userName))
+		smcUserIndex.InvalidateAdmins()
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusNoContent {
+			return smcStatusError(resp.StatusCode, "failed in deleting the user %s", userName)
+		}
+		return nil
+	})
 }
 
-func DetectDeletedUsers() error {
-	err := SmcInstance.Login()
-	if err != nil {
-		logrus.Fatal(err.Error())
-	}
-	defer SmcInstance.Logout()
-	assignedUsers, err := GetAppAssignedUsers(viper.GetString("APP_NAME"))
-	if err != nil {
-		return err
-	}
-	assignedUserNames, err := GetAssignedUsersNames(assignedUsers)
-	if err != nil {
-		return err
-	}
-	allAzureUsers, err := GetAllAzureUsers()
+// delete the SMC users which are known to the identity source but are no longer assigned to the connector app.
+// users unknown to the identity source are not managed by the connector and kept
+func DetectDeletedUsers(ctx context.Context, source IdentitySource) error {
+	assignedUserNames, err := source.AssignedUserNames()
 	if err != nil {
 		return err
 	}
-	allUsers, err := SmcUsers("")
+	allUsers, err := SmcUsers(ctx, "")
 	if err != nil {
 		return err
 	}
-	var smcUsers []string
-	for _, u := range allUsers {
-		smcUsers = append(smcUsers, u["name"])
-	}
-	if err := deleteUsers(assignedUserNames, allAzureUsers, allUsers); err != nil {
+	if err := deleteUsers(ctx, source, assignedUserNames, allUsers); err != nil {
 		return err
 	}
 	return nil
 
 }
 
-func deleteUsers(assignedUserNames []string, allAzureUsers []string, smcUsers []map[string]string) error {
-	var smcUsersNames []string
-	for _, u := range smcUsers {
-		smcUsersNames = append(smcUsersNames, u["name"])
+func deleteUsers(ctx context.Context, source IdentitySource, assignedUserNames []string,
+	smcUsers []map[string]string) error {
+	// the identity sources match user names ignoring the case, so does the assignment check
+	assigned := make(map[string]bool)
+	for _, name := range assignedUserNames {
+		assigned[strings.ToLower(name)] = true
 	}
-	for _, name := range smcUsersNames {
-		if !InSlice(assignedUserNames, name) && InSlice(allAzureUsers, name) {
-			if err := DeleteSmcUser(name); err != nil {
+	for _, u := range smcUsers {
+		name := u["name"]
+		if assigned[strings.ToLower(name)] {
+			continue
+		}
+		exists, err := source.UserExists(name)
+		if err != nil {
+			return err
+		}
+		if exists {
+			if err := DeleteSmcUser(ctx, name); err != nil {
 				return err
 			}
 			logrus.Infof("User %s is been deleted", name)
@@ -599,12 +836,3 @@ func deleteUsers(assignedUserNames []string, allAzureUsers []string, smcUsers []
 	}
 	return nil
 }
-
-func InSlice(list []string, name string) bool {
-	for _, i := range list {
-		if i == name {
-			return true
-		}
-	}
-	return false
-}
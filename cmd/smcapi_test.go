@@ -0,0 +1,119 @@
+package cmd
+
+import (
+	"context"
+	"net/http"
+	"testing"
+)
+
+func TestSetUserActiveConverges(t *testing.T) {
+	f := newFakeSmc(t)
+	defer f.Close()
+	href := f.addAdmin("alice", true)
+
+	for i, want := range []bool{true, false, false} {
+		changed, err := SetUserActive(context.Background(), href, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if changed != want {
+			t.Errorf("call %d: got changed=%t, want %t", i+1, changed, want)
+		}
+	}
+	if enabled := f.admin("alice")["enabled"]; enabled != false {
+		t.Errorf("the admin is enabled=%v, want false", enabled)
+	}
+	if toggles := f.count(http.MethodPut, "/elements/admin_user/1/enable_disable"); toggles != 1 {
+		t.Errorf("got %d toggles, want 1", toggles)
+	}
+}
+
+// an identity source with fixed users, the users are the keys of groups
+type fakeIdentitySource struct {
+	assigned []string
+	groups   map[string][]IdentityGroup
+}
+
+func (s *fakeIdentitySource) AssignedUserNames() ([]string, error) {
+	return s.assigned, nil
+}
+
+func (s *fakeIdentitySource) UserExists(name string) (bool, error) {
+	_, ok := s.groups[name]
+	return ok, nil
+}
+
+func (s *fakeIdentitySource) UserGroups(name string) ([]IdentityGroup, error) {
+	return s.groups[name], nil
+}
+
+func TestSyncWhenSmcIsDown(t *testing.T) {
+	f := newFakeSmc(t)
+	defer f.Close()
+	f.addAdmin("alice", true)
+	f.server.Close()
+
+	source := &fakeIdentitySource{groups: map[string][]IdentityGroup{"alice": {{Name: "Editor"}}}}
+	mappings := []RoleMapping{{Group: "Editor", Roles: []string{"Editor"}}}
+	if err := ApplyRoles(context.Background(), source, mappings); err == nil {
+		t.Error("applying the roles succeeded while SMC is down")
+	}
+	if err := DetectDeletedUsers(context.Background(), source); err == nil {
+		t.Error("detecting the deleted users succeeded while SMC is down")
+	}
+}
+
+func TestApplyRolesKeepsRolesOfUnresolvedMappings(t *testing.T) {
+	f := newFakeSmc(t)
+	defer f.Close()
+	f.addAdmin("alice", true)
+	f.addAdmin("bob", true)
+	viewer := map[string]interface{}{
+		"granted_domain_ref": f.url("/elements/admin_domain/1"),
+		"granted_elements":   []interface{}{f.url("/elements/access_control_list/1")},
+		"role_ref":           f.url("/elements/role/1"),
+	}
+	f.updateAdmin("alice", func(admin map[string]interface{}) {
+		admin["permissions"] = map[string]interface{}{"permission": []interface{}{viewer}}
+	})
+
+	source := &fakeIdentitySource{groups: map[string][]IdentityGroup{
+		"alice": {{Name: "Remote Editors"}},
+		"bob":   {{Name: "Editors"}},
+	}}
+	mappings := []RoleMapping{
+		{Group: "Remote Editors", Roles: []string{"Editor"}, Domains: []string{"Missing Domain"}},
+		{Group: "Editors", Roles: []string{"Editor"}},
+	}
+	if err := ApplyRoles(context.Background(), source, mappings); err != nil {
+		t.Fatal(err)
+	}
+	permissions := f.admin("alice")["permissions"].(map[string]interface{})["permission"].([]interface{})
+	if len(permissions) != 1 || permissions[0].(map[string]interface{})["role_ref"] != viewer["role_ref"] {
+		t.Errorf("got the permissions %v for alice, want the Viewer role kept", permissions)
+	}
+	permissions = f.admin("bob")["permissions"].(map[string]interface{})["permission"].([]interface{})
+	if len(permissions) != 1 || permissions[0].(map[string]interface{})["role_ref"] != f.url("/elements/role/2") {
+		t.Errorf("got the permissions %v for bob, want the Editor role", permissions)
+	}
+}
+
+func TestDetectDeletedUsersIgnoresCase(t *testing.T) {
+	f := newFakeSmc(t)
+	defer f.Close()
+	f.addAdmin("Alice", true)
+	f.addAdmin("Bob", true)
+	f.addAdmin("carol", true)
+
+	source := &fakeIdentitySource{assigned: []string{"alice", "CAROL"},
+		groups: map[string][]IdentityGroup{"Alice": nil, "Bob": nil, "carol": nil}}
+	if err := DetectDeletedUsers(context.Background(), source); err != nil {
+		t.Fatal(err)
+	}
+	// bob is no longer assigned
+	for name, exists := range map[string]bool{"Alice": true, "Bob": false, "carol": true} {
+		if (f.admin(name) != nil) != exists {
+			t.Errorf("the admin %s exists=%t, want %t", name, !exists, exists)
+		}
+	}
+}
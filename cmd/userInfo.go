@@ -2,6 +2,7 @@ package cmd
 
 type UserInfo struct {
 	AuthMethod   string                  `json:"auth_method,omitempty"`
+	Comment      string                  `json:"comment,omitempty"`
 	Enable       bool                    `json:"enabled"`
 	IsUserLocked bool                    `json:"is_user_locked"`
 	LdapUser     string                  `json:"ldap_user,omitempty"`
@@ -17,3 +18,13 @@ type Permission struct {
 	// this is the role assigned to the admin
 	RoleRef string `json:"role_ref"`
 }
+
+// the href of the admin, as it is given in its self link
+func userHref(u UserInfo) string {
+	for _, l := range u.Link {
+		if l["rel"] == "self" {
+			return l["href"]
+		}
+	}
+	return ""
+}
@@ -52,18 +52,14 @@ gpgkey=https://packages.microsoft.com/keys/microsoft.asc" > /etc/yum.repos.d/azu
   cp -f ./nginx/nginx.conf /etc/nginx/nginx.conf
   cp -f ./nginx/conf.d/ssl.conf /etc/nginx/conf.d/
   mkdir /var/azure_smc
-  chmod +x scim-smc smc-connector deployment
-  cp ./scim-smc /var/azure_smc
+  chmod +x smc-connector deployment
   cp ./smc-connector /var/azure_smc
-  cp ./scim.yml /var/azure_smc
   cp ./connector.yml /var/azure_smc
-  cp ./forcepoint_scim.service /etc/systemd/system/
   cp ./smc_connector.service /etc/systemd/system/
   yum provides /usr/sbin/semanage
   yum install policycoreutils-python -y
   echo "$1 smc.com" >> /etc/hosts
   sudo systemctl enable nginx.service
-  sudo systemctl enable forcepoint_scim.service
   sudo systemctl enable smc_connector.service
 else
   echo "the passed value '$1' is not a valid ip address"
@@ -5,11 +5,13 @@ go 1.13
 require (
 	github.cicd.cloud.fpdev.io/BD/fp-smc-golang v0.0.22
 	github.com/fsnotify/fsnotify v1.4.7
+	github.com/go-asn1-ber/asn1-ber v1.5.1
+	github.com/go-ldap/ldap/v3 v3.3.0
 	github.com/gorilla/mux v1.7.3
 	github.com/mitchellh/go-homedir v1.1.0
 	github.com/pkg/errors v0.9.1
 	github.com/sirupsen/logrus v1.4.2
 	github.com/spf13/cobra v0.0.5
 	github.com/spf13/viper v1.3.2
-	golang.org/x/crypto v0.0.0-20181203042331-505ab145d0a9
+	golang.org/x/crypto v0.0.0-20200604202706-70a84ac30bf9
 )
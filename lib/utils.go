@@ -1,12 +1,26 @@
 package lib
 
 import (
+	"context"
 	"errors"
 	"github.cicd.cloud.fpdev.io/BD/fp-smc-golang/src/smc"
 	"os"
 	"strings"
+	"time"
 )
 
+// sleep for the given duration, or until the context is done
+func SleepContext(ctx context.Context, duration time.Duration) error {
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 func FileExists(filename string) bool {
 	info, err := os.Stat(filename)
 	if os.IsNotExist(err) {
@@ -38,7 +52,8 @@ func CompareRoles(p1 []smc.Permission, p2 []smc.Permission) bool {
 	for _, p := range p1 {
 		matched := false
 		for _, n := range p2 {
-			if p.RoleRef == n.RoleRef {
+			if p.RoleRef == n.RoleRef && elementRef(p.GrantedDomainRef) == elementRef(n.GrantedDomainRef) &&
+				sameElementRefs(p.GrantedElements, n.GrantedElements) {
 				matched = true
 			}
 		}
@@ -49,6 +64,32 @@ func CompareRoles(p1 []smc.Permission, p2 []smc.Permission) bool {
 	return true
 }
 
+// the part of an element href following the API version, hrefs built by the connector and hrefs returned by SMC may
+// differ in their host
+func elementRef(href string) string {
+	if i := strings.Index(href, "/elements/"); i != -1 {
+		return href[i:]
+	}
+	return href
+}
+
+func sameElementRefs(r1 []string, r2 []string) bool {
+	if len(r1) != len(r2) {
+		return false
+	}
+	refs := make(map[string]int)
+	for _, r := range r1 {
+		refs[elementRef(r)]++
+	}
+	for _, r := range r2 {
+		if refs[elementRef(r)] == 0 {
+			return false
+		}
+		refs[elementRef(r)]--
+	}
+	return true
+}
+
 func ExtractName(email string) (string, error) {
 	parts := strings.Split(email, "@")
 	if len(parts) != 2 {